@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+const blocklistReloadInterval = 30 * time.Second
+
+var blockedPageTemplate = template.Must(template.New("blocked").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Link blocked</title>
+</head>
+<body>
+	<h1>This link has been blocked</h1>
+	<p>The destination of this link{{if .Host}} on <strong>{{.Host}}</strong>{{end}} has been reported as harmful and is no longer forwarded.</p>
+</body>
+</html>
+`))
+
+// blocklistRules is one parsed version of the blocklist file.
+type blocklistRules struct {
+	domains  []string
+	patterns []*regexp.Regexp
+}
+
+// blocklist holds the destinations links may not point to. It is loaded from
+// a local file and swapped atomically whenever the file changes, so lookups
+// never block on a reload.
+type blocklist struct {
+	path    string
+	rules   atomic.Pointer[blocklistRules]
+	modTime time.Time
+	size    int64
+}
+
+// blocklistFromEnv loads the file named by BLOCKLIST_FILE. Without it the
+// blocklist is empty.
+func blocklistFromEnv() (*blocklist, error) {
+	list := &blocklist{path: os.Getenv("BLOCKLIST_FILE")}
+	list.rules.Store(&blocklistRules{})
+	if list.path == "" {
+		return list, nil
+	}
+	if _, err := list.reload(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// parseBlocklist reads one entry per line. Blank lines and lines starting
+// with # are ignored. An entry containing a slash or an asterisk is a URL
+// pattern matched against the destination without its scheme, where *
+// matches any run of characters; any other entry is a domain that blocks
+// itself and all of its subdomains.
+func parseBlocklist(file *os.File) (*blocklistRules, error) {
+	rules := &blocklistRules{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		if strings.ContainsAny(entry, "/*") {
+			pattern := strings.ReplaceAll(regexp.QuoteMeta(entry), `\*`, `.*`)
+			rules.patterns = append(rules.patterns, regexp.MustCompile("^"+pattern+"$"))
+			continue
+		}
+
+		domain := normalizeHostname(entry)
+		if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+			domain = ascii
+		}
+		rules.domains = append(rules.domains, domain)
+	}
+	return rules, scanner.Err()
+}
+
+// reload parses the file again when its size or modification time changed
+// since the last load and reports whether it did.
+func (b *blocklist) reload() (bool, error) {
+	file, err := os.Open(b.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(b.modTime) && info.Size() == b.size {
+		return false, nil
+	}
+
+	rules, err := parseBlocklist(file)
+	if err != nil {
+		return false, err
+	}
+
+	b.rules.Store(rules)
+	b.modTime = info.ModTime()
+	b.size = info.Size()
+	return true, nil
+}
+
+// watch reloads the blocklist file every interval until ctx is cancelled. A
+// file that fails to load leaves the previous rules in place.
+func (b *blocklist) watch(ctx context.Context, interval time.Duration) {
+	if b.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := b.reload()
+			if err != nil {
+				log.Println("Error reloading blocklist:", err)
+				continue
+			}
+			if reloaded {
+				rules := b.rules.Load()
+				log.Println("Reloaded blocklist with", len(rules.domains), "domains and", len(rules.patterns), "patterns")
+			}
+		}
+	}
+}
+
+// Blocked reports whether destination is on the blocklist.
+func (b *blocklist) Blocked(destination string) bool {
+	rules := b.rules.Load()
+	if len(rules.domains) == 0 && len(rules.patterns) == 0 {
+		return false
+	}
+
+	target, err := url.Parse(destination)
+	if err != nil {
+		return false
+	}
+
+	host := normalizeHostname(target.Hostname())
+	for _, domain := range rules.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	withoutScheme := strings.ToLower(strings.TrimPrefix(destination, target.Scheme+"://"))
+	for _, pattern := range rules.patterns {
+		if pattern.MatchString(withoutScheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// BlocksLink reports whether any destination configured on link is on the
+// blocklist.
+func (b *blocklist) BlocksLink(link *Url) bool {
+	if b.Blocked(link.LongUrl) {
+		return true
+	}
+	if link.FallbackUrl != "" && b.Blocked(link.FallbackUrl) {
+		return true
+	}
+	for _, rule := range link.TargetingRules {
+		if b.Blocked(rule.Destination) {
+			return true
+		}
+	}
+	for _, variant := range link.Variants {
+		if b.Blocked(variant.Destination) {
+			return true
+		}
+	}
+	for _, change := range link.ScheduledDestinations {
+		if b.Blocked(change.Destination) {
+			return true
+		}
+	}
+	return false
+}
+
+func renderBlockedPage(w http.ResponseWriter, destination string) {
+	host := ""
+	if target, err := url.Parse(destination); err == nil {
+		host = target.Hostname()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	blockedPageTemplate.Execute(w, struct{ Host string }{host})
+}
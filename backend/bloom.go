@@ -0,0 +1,235 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"math"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+const (
+	bloomFalsePositiveRate = 0.01
+	bloomMinCapacity       = 100000
+)
+
+// countingBloomFilter is a Bloom filter with small saturating counters
+// instead of bits, so items can be removed again.
+type countingBloomFilter struct {
+	mu       sync.RWMutex
+	counters []uint8
+	hashes   int
+}
+
+func newCountingBloomFilter(capacity int, falsePositiveRate float64) *countingBloomFilter {
+	size := int(math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	hashes := max(int(math.Round(float64(size)/float64(capacity)*math.Ln2)), 1)
+	return &countingBloomFilter{
+		counters: make([]uint8, size),
+		hashes:   hashes,
+	}
+}
+
+func (f *countingBloomFilter) Add(item string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, i := range f.indexes(item) {
+		if f.counters[i] < math.MaxUint8 {
+			f.counters[i]++
+		}
+	}
+}
+
+// Remove must only be called for items that were added before.
+func (f *countingBloomFilter) Remove(item string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, i := range f.indexes(item) {
+		// A saturated counter no longer knows how many items share it.
+		if f.counters[i] > 0 && f.counters[i] < math.MaxUint8 {
+			f.counters[i]--
+		}
+	}
+}
+
+func (f *countingBloomFilter) MightContain(item string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, i := range f.indexes(item) {
+		if f.counters[i] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// indexes derives the counter positions for item by double hashing a single
+// 64-bit FNV-1a hash.
+func (f *countingBloomFilter) indexes(item string) []uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(item))
+	sum := hasher.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32
+
+	size := uint64(len(f.counters))
+	indexes := make([]uint64, f.hashes)
+	for i := range indexes {
+		indexes[i] = (h1 + uint64(i)*h2) % size
+	}
+	return indexes
+}
+
+// bloomUrlStore decorates a urlStore with a Bloom filter of the keys of every
+// existing alias, answering lookups for codes that cannot exist without calling
+// the wrapped store.
+type bloomUrlStore struct {
+	urlStore
+
+	mu     sync.RWMutex
+	filter *countingBloomFilter
+}
+
+func newBloomUrlStore(inner urlStore) (*bloomUrlStore, error) {
+	s := &bloomUrlStore{urlStore: inner}
+	if err := s.rebuild(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// rebuild replaces the filter with one built from the codes currently in the
+// store. The lock is held across the query so a code added concurrently is
+// either part of the snapshot or added to the new filter afterwards.
+func (s *bloomUrlStore) rebuild() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	urls, err := s.urlStore.ListShortURLs()
+	if err != nil {
+		return err
+	}
+
+	filter := newCountingBloomFilter(max(2*len(urls), bloomMinCapacity), bloomFalsePositiveRate)
+	for _, url := range urls {
+		filter.Add(linkKey(url.Domain, url.ShortUrl))
+	}
+	s.filter = filter
+	return nil
+}
+
+func (s *bloomUrlStore) current() *countingBloomFilter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.filter
+}
+
+// removeKeys removes keys from filter, the filter that was current before
+// the store call removing them, unless a rebuild replaced it since. The new
+// filter already reflects the removal, and decrementing it could drop
+// counters that belong to live codes.
+func (s *bloomUrlStore) removeKeys(filter *countingBloomFilter, keys ...string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.filter != filter {
+		return
+	}
+	for _, key := range keys {
+		filter.Remove(key)
+	}
+}
+
+func (s *bloomUrlStore) GetByShortURL(domain, shortUrl string) (Url, error) {
+	if !s.current().MightContain(linkKey(domain, shortUrl)) {
+		return Url{}, gorm.ErrRecordNotFound
+	}
+	return s.urlStore.GetByShortURL(domain, shortUrl)
+}
+
+func (s *bloomUrlStore) Add(entry *Url) error {
+	err := s.urlStore.Add(entry)
+	if err == nil {
+		s.current().Add(linkKey(entry.Domain, entry.ShortUrl))
+	}
+	return err
+}
+
+func (s *bloomUrlStore) Update(urlId string, entry *Url) error {
+	previous, err := s.urlStore.GetByID(urlId)
+	if err != nil {
+		return err
+	}
+
+	filter := s.current()
+	if err := s.urlStore.Update(urlId, entry); err != nil {
+		return err
+	}
+
+	previousKey, key := linkKey(previous.Domain, previous.ShortUrl), linkKey(entry.Domain, entry.ShortUrl)
+	if previousKey != key {
+		s.current().Add(key)
+		s.removeKeys(filter, previousKey)
+	}
+	return nil
+}
+
+func (s *bloomUrlStore) Remove(urlId string) error {
+	aliases, err := s.urlStore.ListAliases(urlId)
+	if err != nil {
+		return err
+	}
+
+	filter := s.current()
+	if err := s.urlStore.Remove(urlId); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		keys = append(keys, linkKey(alias.Domain, alias.ShortUrl))
+	}
+	s.removeKeys(filter, keys...)
+	return nil
+}
+
+func (s *bloomUrlStore) AddAlias(alias *Alias) error {
+	err := s.urlStore.AddAlias(alias)
+	if err == nil {
+		s.current().Add(linkKey(alias.Domain, alias.ShortUrl))
+	}
+	return err
+}
+
+func (s *bloomUrlStore) RemoveAlias(urlId, aliasId string) error {
+	aliases, err := s.urlStore.ListAliases(urlId)
+	if err != nil {
+		return err
+	}
+
+	filter := s.current()
+	if err := s.urlStore.RemoveAlias(urlId, aliasId); err != nil {
+		return err
+	}
+
+	for _, alias := range aliases {
+		if alias.ID == aliasId {
+			s.removeKeys(filter, linkKey(alias.Domain, alias.ShortUrl))
+		}
+	}
+	return nil
+}
+
+// ApplyChange records a code reported by any instance. Codes are never
+// removed here since the change may not have been counted locally; a stale
+// code merely costs one database lookup.
+func (s *bloomUrlStore) ApplyChange(change urlChange) {
+	if change.ShortUrl != "" && !change.Deleted {
+		s.current().Add(linkKey(change.Domain, change.ShortUrl))
+	}
+}
+
+func (s *bloomUrlStore) Resync() {
+	if err := s.rebuild(); err != nil {
+		log.Println("Error rebuilding short code filter:", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultRedirectCacheSize = 10000
+	defaultRedirectCacheTTL  = time.Minute
+)
+
+// cachedUrlStore decorates a urlStore with a size-bounded LRU cache of
+// GetByShortURL results. Lookups for unknown codes are cached as well so
+// repeated misses don't reach the database.
+type cachedUrlStore struct {
+	urlStore
+
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	keysByID map[string]map[string]bool
+	order    *list.List
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type cacheEntry struct {
+	key       string
+	url       Url
+	found     bool
+	expiresAt time.Time
+}
+
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Size   int   `json:"size"`
+}
+
+func newCachedUrlStore(inner urlStore, capacity int, ttl time.Duration) *cachedUrlStore {
+	return &cachedUrlStore{
+		urlStore: inner,
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		keysByID: make(map[string]map[string]bool),
+		order:    list.New(),
+	}
+}
+
+// cachedUrlStoreFromEnv reads REDIRECT_CACHE_SIZE and REDIRECT_CACHE_TTL
+// (a time.ParseDuration string), falling back to the defaults.
+func cachedUrlStoreFromEnv(inner urlStore) *cachedUrlStore {
+	capacity, err := strconv.Atoi(os.Getenv("REDIRECT_CACHE_SIZE"))
+	if err != nil || capacity <= 0 {
+		capacity = defaultRedirectCacheSize
+	}
+	ttl, err := time.ParseDuration(os.Getenv("REDIRECT_CACHE_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = defaultRedirectCacheTTL
+	}
+	return newCachedUrlStore(inner, capacity, ttl)
+}
+
+func (c *cachedUrlStore) GetByShortURL(domain, shortUrl string) (Url, error) {
+	key := linkKey(domain, shortUrl)
+	if entry, ok := c.get(key); ok {
+		c.hits.Add(1)
+		if !entry.found {
+			return Url{}, gorm.ErrRecordNotFound
+		}
+		return entry.url, nil
+	}
+	c.misses.Add(1)
+
+	url, err := c.urlStore.GetByShortURL(domain, shortUrl)
+	switch {
+	case err == nil:
+		c.put(&cacheEntry{key: key, url: url, found: true})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.put(&cacheEntry{key: key})
+	}
+	return url, err
+}
+
+func (c *cachedUrlStore) Add(entry *Url) error {
+	err := c.urlStore.Add(entry)
+	if err == nil {
+		c.Invalidate(linkKey(entry.Domain, entry.ShortUrl))
+	}
+	return err
+}
+
+func (c *cachedUrlStore) Update(urlId string, entry *Url) error {
+	err := c.urlStore.Update(urlId, entry)
+	if err == nil {
+		c.InvalidateID(urlId)
+		c.Invalidate(linkKey(entry.Domain, entry.ShortUrl))
+	}
+	return err
+}
+
+func (c *cachedUrlStore) SetPaused(urlId string, pausedAt *time.Time) error {
+	err := c.urlStore.SetPaused(urlId, pausedAt)
+	if err == nil {
+		c.InvalidateID(urlId)
+	}
+	return err
+}
+
+func (c *cachedUrlStore) SetDisabled(urlId string, disabledAt *time.Time, reason string) error {
+	err := c.urlStore.SetDisabled(urlId, disabledAt, reason)
+	if err == nil {
+		c.InvalidateID(urlId)
+	}
+	return err
+}
+
+func (c *cachedUrlStore) ApplyScheduledDestination(urlId, longUrl string, remaining []ScheduledDestination, expectedUpdatedAt time.Time) (bool, error) {
+	applied, err := c.urlStore.ApplyScheduledDestination(urlId, longUrl, remaining, expectedUpdatedAt)
+	if applied {
+		c.InvalidateID(urlId)
+	}
+	return applied, err
+}
+
+func (c *cachedUrlStore) Remove(urlId string) error {
+	err := c.urlStore.Remove(urlId)
+	if err == nil {
+		c.InvalidateID(urlId)
+	}
+	return err
+}
+
+func (c *cachedUrlStore) AddAlias(alias *Alias) error {
+	err := c.urlStore.AddAlias(alias)
+	if err == nil {
+		c.Invalidate(linkKey(alias.Domain, alias.ShortUrl))
+	}
+	return err
+}
+
+func (c *cachedUrlStore) RemoveAlias(urlId, aliasId string) error {
+	err := c.urlStore.RemoveAlias(urlId, aliasId)
+	if err == nil {
+		c.InvalidateID(urlId)
+	}
+	return err
+}
+
+// Invalidate drops the cached lookups for the given link keys.
+func (c *cachedUrlStore) Invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := c.entries[key]; ok {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// InvalidateID drops the cached lookups of every alias of the link with the
+// given ID.
+func (c *cachedUrlStore) InvalidateID(urlId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.keysByID[urlId] {
+		c.removeElement(c.entries[key])
+	}
+}
+
+func (c *cachedUrlStore) ApplyChange(change urlChange) {
+	c.InvalidateID(change.ID)
+	if change.ShortUrl != "" {
+		c.Invalidate(linkKey(change.Domain, change.ShortUrl))
+	}
+}
+
+// Resync purges the cache since changes may have been missed.
+func (c *cachedUrlStore) Resync() {
+	c.Purge()
+}
+
+// Purge drops every cached lookup.
+func (c *cachedUrlStore) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.keysByID = make(map[string]map[string]bool)
+	c.order.Init()
+}
+
+func (c *cachedUrlStore) Stats() CacheStats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Size:   size,
+	}
+}
+
+func (c *cachedUrlStore) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry, true
+}
+
+func (c *cachedUrlStore) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.expiresAt = time.Now().Add(c.ttl)
+	if elem, ok := c.entries[entry.key]; ok {
+		c.removeElement(elem)
+	}
+
+	c.entries[entry.key] = c.order.PushFront(entry)
+	if entry.found {
+		keys, ok := c.keysByID[entry.url.ID]
+		if !ok {
+			keys = make(map[string]bool)
+			c.keysByID[entry.url.ID] = keys
+		}
+		keys[entry.key] = true
+	}
+
+	for c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *cachedUrlStore) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	if entry.found {
+		keys := c.keysByID[entry.url.ID]
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(c.keysByID, entry.url.ID)
+		}
+	}
+}
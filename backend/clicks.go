@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultClickBufferSize    = 10000
+	defaultClickBatchSize     = 500
+	defaultClickFlushInterval = 2 * time.Second
+)
+
+// clickRecorder persists click events off the request path. Events are queued
+// on a bounded channel and written in batches by a single goroutine; when the
+// queue is full new events are dropped rather than slowing down redirects.
+type clickRecorder struct {
+	store         clickStore
+	events        chan ClickEvent
+	batchSize     int
+	flushInterval time.Duration
+	ipHashKey     []byte
+	wg            sync.WaitGroup
+	closeOnce     sync.Once
+}
+
+func newClickRecorder(store clickStore, ipHashKey []byte) *clickRecorder {
+	return &clickRecorder{
+		store:         store,
+		events:        make(chan ClickEvent, defaultClickBufferSize),
+		batchSize:     defaultClickBatchSize,
+		flushInterval: defaultClickFlushInterval,
+		ipHashKey:     ipHashKey,
+	}
+}
+
+func (r *clickRecorder) Start() {
+	r.wg.Add(1)
+	go r.run()
+}
+
+// Close stops accepting events and blocks until everything still queued has
+// been written. It must only be called once no more handlers can call Record.
+func (r *clickRecorder) Close() {
+	r.closeOnce.Do(func() {
+		close(r.events)
+	})
+	r.wg.Wait()
+}
+
+// Record queues a click on url. variant names the A/B variant the visitor
+// was sent to, if any.
+func (r *clickRecorder) Record(url *Url, req *http.Request, variant string) {
+	event := ClickEvent{
+		UrlId:     url.ID,
+		ClickedAt: time.Now(),
+		Referrer:  req.Referer(),
+		UserAgent: req.UserAgent(),
+		IPHash:    r.hashIP(clientIP(req)),
+		Country:   clientCountry(req),
+		Device:    parseUserAgent(req.UserAgent()).Device,
+		Variant:   variant,
+	}
+
+	select {
+	case r.events <- event:
+	default:
+		log.Println("Click queue full, dropping event for URL", url.ID)
+	}
+}
+
+func (r *clickRecorder) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]ClickEvent, 0, r.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := r.store.AddBatch(batch); err != nil {
+			log.Println("Error writing", len(batch), "click events:", err)
+		}
+		batch = make([]ClickEvent, 0, r.batchSize)
+	}
+
+	for {
+		select {
+		case event, ok := <-r.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= r.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (r *clickRecorder) hashIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, r.ipHashKey)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// countryHeaders are set by the CDN or load balancer in front of the service;
+// the first non-empty one wins.
+var countryHeaders = []string{"CF-IPCountry", "CloudFront-Viewer-Country", "X-Country-Code"}
+
+func clientCountry(req *http.Request) string {
+	for _, header := range countryHeaders {
+		if country := req.Header.Get(header); country != "" {
+			return strings.ToUpper(country)
+		}
+	}
+	return ""
+}
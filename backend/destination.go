@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidDestination = errors.New("invalid destination")
+
+var defaultAllowedSchemes = []string{"http", "https"}
+
+// trackingParams are removed from destinations when STRIP_TRACKING_PARAMS is
+// enabled, together with every utm_* parameter.
+var trackingParams = []string{
+	"fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid", "yclid",
+	"mc_cid", "mc_eid", "igshid", "_ga", "_gl", "_hsenc", "_hsmi",
+}
+
+// destinationPolicy validates and normalizes the destinations links point
+// to.
+type destinationPolicy struct {
+	allowedSchemes []string
+	stripTracking  bool
+	defaultHost    string
+	domains        domainStore
+	blocklist      *blocklist
+}
+
+// destinationPolicyFromEnv reads ALLOWED_SCHEMES, a comma separated list
+// defaulting to http and https, and STRIP_TRACKING_PARAMS.
+func destinationPolicyFromEnv(defaultHost string, domains domainStore, blocked *blocklist) *destinationPolicy {
+	policy := &destinationPolicy{
+		allowedSchemes: defaultAllowedSchemes,
+		defaultHost:    defaultHost,
+		domains:        domains,
+		blocklist:      blocked,
+	}
+
+	if schemes := os.Getenv("ALLOWED_SCHEMES"); schemes != "" {
+		policy.allowedSchemes = nil
+		for _, scheme := range strings.Split(schemes, ",") {
+			if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+				policy.allowedSchemes = append(policy.allowedSchemes, scheme)
+			}
+		}
+	}
+
+	stripTracking, err := strconv.ParseBool(os.Getenv("STRIP_TRACKING_PARAMS"))
+	policy.stripTracking = err == nil && stripTracking
+
+	return policy
+}
+
+func invalidDestination(field, format string, args ...any) error {
+	return fmt.Errorf("%w: %s %s", ErrInvalidDestination, field, fmt.Sprintf(format, args...))
+}
+
+// canonicalizeRequest replaces every destination of r with its canonical
+// form.
+func (p *destinationPolicy) canonicalizeRequest(r *urlRequest) error {
+	var err error
+	if r.LongUrl, err = p.canonicalize("long_url", r.LongUrl); err != nil {
+		return err
+	}
+	if r.FallbackUrl != "" {
+		if r.FallbackUrl, err = p.canonicalize("fallback_url", r.FallbackUrl); err != nil {
+			return err
+		}
+	}
+	for i := range r.TargetingRules {
+		field := fmt.Sprintf("targeting_rules[%d].destination", i)
+		if r.TargetingRules[i].Destination, err = p.canonicalize(field, r.TargetingRules[i].Destination); err != nil {
+			return err
+		}
+	}
+	for i := range r.ScheduledDestinations {
+		field := fmt.Sprintf("scheduled_destinations[%d].destination", i)
+		if r.ScheduledDestinations[i].Destination, err = p.canonicalize(field, r.ScheduledDestinations[i].Destination); err != nil {
+			return err
+		}
+	}
+	for i := range r.Variants {
+		field := fmt.Sprintf("variants[%d].destination", i)
+		if r.Variants[i].Destination, err = p.canonicalize(field, r.Variants[i].Destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canonicalize checks that raw is an absolute URL with an allowed scheme
+// that is not blocked and does not lead back to this service, and normalizes its host to
+// lowercase ASCII without a default port.
+func (p *destinationPolicy) canonicalize(field, raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", invalidDestination(field, "must not be empty")
+	}
+
+	target, err := url.Parse(raw)
+	if err != nil {
+		return "", invalidDestination(field, "is not a valid URL")
+	}
+
+	target.Scheme = strings.ToLower(target.Scheme)
+	if target.Scheme != "" && !slices.Contains(p.allowedSchemes, target.Scheme) {
+		return "", invalidDestination(field, "scheme must be one of %s", strings.Join(p.allowedSchemes, ", "))
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return "", invalidDestination(field, "must be an absolute URL")
+	}
+	if target.User != nil {
+		return "", invalidDestination(field, "must not contain credentials")
+	}
+
+	host := normalizeHostname(target.Hostname())
+	if net.ParseIP(host) == nil {
+		host, err = idna.Lookup.ToASCII(host)
+		if err != nil || host == "" {
+			return "", invalidDestination(field, "has an invalid host")
+		}
+	}
+
+	port := target.Port()
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", invalidDestination(field, "has an invalid port")
+		}
+	}
+	if (target.Scheme == "http" && port == "80") || (target.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		target.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		target.Host = "[" + host + "]"
+	} else {
+		target.Host = host
+	}
+
+	loops, err := p.pointsAtShortener(host)
+	if err != nil {
+		return "", err
+	}
+	if loops {
+		return "", invalidDestination(field, "must not point back at this URL shortener")
+	}
+
+	if p.stripTracking {
+		stripTrackingParams(target)
+	}
+
+	canonical := target.String()
+	if p.blocklist.Blocked(canonical) {
+		return "", invalidDestination(field, "points to a blocked destination")
+	}
+
+	return canonical, nil
+}
+
+// pointsAtShortener reports whether host is served by this service: the
+// default host or a verified custom domain. Pending claims do not count, as
+// anyone can claim any hostname.
+func (p *destinationPolicy) pointsAtShortener(host string) (bool, error) {
+	if p.defaultHost != "" && host == p.defaultHost {
+		return true, nil
+	}
+
+	_, err := p.domains.GetVerifiedByHostname(host)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func stripTrackingParams(target *url.URL) {
+	query := target.Query()
+	stripped := false
+	for key := range query {
+		if strings.HasPrefix(strings.ToLower(key), "utm_") || slices.Contains(trackingParams, strings.ToLower(key)) {
+			query.Del(key)
+			stripped = true
+		}
+	}
+	if stripped {
+		target.RawQuery = query.Encode()
+	}
+}
+
+func writeDestinationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrInvalidDestination) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Error validating destination", http.StatusInternalServerError)
+	log.Println("Error validating destination :", err)
+}
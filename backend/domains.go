@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	domainVerificationPrefix = "_shortener-verification."
+	domainVerificationValue  = "shortener-verification="
+	dnsLookupTimeout         = 5 * time.Second
+)
+
+var (
+	ErrDomainNotVerified     = errors.New("domain ownership could not be verified")
+	ErrDomainNotOwned        = errors.New("domain is not a verified domain of this user")
+	ErrCustomDomainsDisabled = errors.New("custom domains require BASE_URL to be set")
+)
+
+// txtResolver looks up DNS TXT records. *net.Resolver satisfies it; tests can
+// substitute a fake.
+type txtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// linkKey identifies a link by its domain and short code. The default domain
+// is the empty string.
+func linkKey(domain, shortUrl string) string {
+	return domain + "/" + shortUrl
+}
+
+func normalizeHostname(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// requestDomain returns the link namespace addressed by req: the empty
+// default namespace for the service's own host, or the requested hostname
+// for custom domains. Without a configured default host every request uses
+// the default namespace.
+func requestDomain(req *http.Request, defaultHost string) string {
+	if defaultHost == "" {
+		return ""
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeHostname(host)
+
+	if host == defaultHost {
+		return ""
+	}
+	return host
+}
+
+// fullShortUrl returns the public address of link. Links on the default
+// domain use baseURL, or the host the API was reached on when it is unset.
+func fullShortUrl(req *http.Request, baseURL string, link *Url) string {
+	path := "/" + url.PathEscape(link.ShortUrl)
+	if link.Domain != "" {
+		return "https://" + link.Domain + path
+	}
+	if baseURL != "" {
+		return baseURL + path
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + path
+}
+
+func domainVerificationRecord(domain *Domain) string {
+	return domainVerificationPrefix + domain.Hostname
+}
+
+// verifyDomainOwnership checks that the domain publishes its verification
+// token in a TXT record.
+func verifyDomainOwnership(ctx context.Context, resolver txtResolver, domain *Domain) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+
+	records, err := resolver.LookupTXT(ctx, domainVerificationRecord(domain))
+	if err != nil {
+		return ErrDomainNotVerified
+	}
+
+	if !slices.Contains(records, domainVerificationValue+domain.VerificationToken) {
+		return ErrDomainNotVerified
+	}
+	return nil
+}
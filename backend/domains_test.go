@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// fakeResolver answers TXT lookups from a fixed table of records.
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+// fakeDomainStore keeps domains in memory. Methods VerifyDomain does not use
+// are left to the embedded nil interface.
+type fakeDomainStore struct {
+	domainStore
+	domains map[string]Domain
+}
+
+func (s *fakeDomainStore) GetByID(domainId string) (Domain, error) {
+	domain, ok := s.domains[domainId]
+	if !ok {
+		return Domain{}, gorm.ErrRecordNotFound
+	}
+	return domain, nil
+}
+
+func (s *fakeDomainStore) MarkVerified(domainId string, at time.Time) error {
+	domain := s.domains[domainId]
+	domain.VerifiedAt = &at
+	s.domains[domainId] = domain
+	return nil
+}
+
+func TestVerifyDomain(t *testing.T) {
+	const record = "_shortener-verification.links.example.com"
+	owner := uuid.NewString()
+
+	tests := []struct {
+		name         string
+		records      fakeResolver
+		userID       string
+		wantStatus   int
+		wantVerified bool
+	}{
+		{
+			name:         "matching record",
+			records:      fakeResolver{record: {"unrelated", "shortener-verification=token"}},
+			userID:       owner,
+			wantStatus:   http.StatusOK,
+			wantVerified: true,
+		},
+		{
+			name:       "wrong token",
+			records:    fakeResolver{record: {"shortener-verification=other"}},
+			userID:     owner,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing record",
+			records:    fakeResolver{},
+			userID:     owner,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "other user",
+			records:    fakeResolver{record: {"shortener-verification=token"}},
+			userID:     uuid.NewString(),
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domainID := uuid.NewString()
+			store := &fakeDomainStore{domains: map[string]Domain{
+				domainID: {
+					ID:                domainID,
+					Hostname:          "links.example.com",
+					UserId:            owner,
+					VerificationToken: "token",
+				},
+			}}
+			handler := &apiHandler{domainDb: store, resolver: tt.records}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/domain/"+domainID+"/verify", nil)
+			req.SetPathValue("route", "domain/"+domainID+"/verify")
+			req = req.WithContext(context.WithValue(req.Context(), "userID", tt.userID))
+			rec := httptest.NewRecorder()
+
+			handler.VerifyDomain(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if verified := store.domains[domainID].VerifiedAt != nil; verified != tt.wantVerified {
+				t.Errorf("verified = %v, want %v", verified, tt.wantVerified)
+			}
+		})
+	}
+}
@@ -6,25 +6,206 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
+const statsTopN = 10
+
+// urlRequest is the body of CreateUrl and UpdateUrl. AccessPassword is left
+// untouched when omitted and cleared when empty; an omitted Domain or
+// ShortUrl keeps the link's current one on update, so moving a link to the
+// default domain takes an explicit empty domain; TargetingRules are evaluated
+// in order and the first match wins.
 type urlRequest struct {
-	ID       string `json:"id"`
-	ShortUrl string `json:"short_url"`
-	LongUrl  string `json:"long_url"`
+	ID                    string                 `json:"id"`
+	Domain                *string                `json:"domain"`
+	ShortUrl              string                 `json:"short_url"`
+	LongUrl               string                 `json:"long_url"`
+	StartsAt              *time.Time             `json:"starts_at"`
+	ExpiresAt             *time.Time             `json:"expires_at"`
+	FallbackUrl           string                 `json:"fallback_url"`
+	MaxClicks             int64                  `json:"max_clicks"`
+	AccessPassword        *string                `json:"access_password"`
+	RedirectStatus        int                    `json:"redirect_status"`
+	CacheMaxAge           int                    `json:"cache_max_age"`
+	ReferrerPolicy        string                 `json:"referrer_policy"`
+	ForwardQuery          bool                   `json:"forward_query"`
+	PathPassthrough       bool                   `json:"path_passthrough"`
+	TargetingRules        []TargetingRule        `json:"targeting_rules"`
+	Variants              []Variant              `json:"variants"`
+	ScheduledDestinations []ScheduledDestination `json:"scheduled_destinations"`
+	UTM                   UTMParams              `json:"utm"`
+	Dedupe                *bool                  `json:"dedupe"`
+	OverrideReserved      bool                   `json:"override_reserved"`
+}
+
+func (r *urlRequest) validate() error {
+	if r.Domain != nil {
+		domain := normalizeHostname(*r.Domain)
+		r.Domain = &domain
+	}
+	if r.MaxClicks < 0 {
+		return errors.New("max_clicks must not be negative")
+	}
+	if r.AccessPassword != nil && len(*r.AccessPassword) > 72 {
+		return errors.New("access_password must be at most 72 bytes long")
+	}
+	if err := validateRedirectProfile(r.RedirectStatus, r.CacheMaxAge, r.ReferrerPolicy); err != nil {
+		return err
+	}
+	if err := validateTargetingRules(r.TargetingRules); err != nil {
+		return err
+	}
+	if err := validateVariants(r.Variants); err != nil {
+		return err
+	}
+	if err := validateSchedule(r.StartsAt, r.ExpiresAt, r.ScheduledDestinations); err != nil {
+		return err
+	}
+
+	utm, err := buildUTMParams(r.UTM)
+	if err != nil {
+		return err
+	}
+	r.UTM = utm
+	return nil
+}
+
+// domainOrDefault is the requested domain, the default one when omitted.
+func (r *urlRequest) domainOrDefault() string {
+	if r.Domain == nil {
+		return ""
+	}
+	return *r.Domain
+}
+
+// apply copies the client-editable fields of the request onto entry.
+func (r *urlRequest) apply(entry *Url) error {
+	if r.Domain != nil {
+		entry.Domain = *r.Domain
+	}
+	entry.ShortUrl = r.ShortUrl
+	entry.LongUrl = r.LongUrl
+	entry.StartsAt = r.StartsAt
+	entry.ExpiresAt = r.ExpiresAt
+	entry.FallbackUrl = r.FallbackUrl
+	entry.MaxClicks = r.MaxClicks
+	entry.RedirectStatus = r.RedirectStatus
+	entry.CacheMaxAge = r.CacheMaxAge
+	entry.ReferrerPolicy = r.ReferrerPolicy
+	entry.ForwardQuery = r.ForwardQuery
+	entry.PathPassthrough = r.PathPassthrough
+	entry.TargetingRules = r.TargetingRules
+	entry.Variants = r.Variants
+	entry.ScheduledDestinations = r.ScheduledDestinations
+	entry.UTM = r.UTM
+	if !entry.Expired(time.Now()) {
+		entry.ArchivedAt = nil
+	}
+
+	if r.AccessPassword != nil {
+		entry.AccessPasswordHash = ""
+		if *r.AccessPassword != "" {
+			hashedPassword, err := HashPassword(*r.AccessPassword)
+			if err != nil {
+				return err
+			}
+			entry.AccessPasswordHash = hashedPassword
+		}
+	}
+	entry.PasswordProtected = entry.AccessPasswordHash != ""
+
+	return nil
 }
 
 func (h *shortUrlHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	url, err := h.urlDb.GetByShortURL(req.URL.Path[1:])
+	url, err := h.urlDb.GetByShortURL(requestDomain(req, h.defaultHost), req.PathValue("short_url"))
 	if err != nil {
 		http.Error(w, "URL not found", http.StatusNotFound)
 		return
 	}
-	http.Redirect(w, req, url.LongUrl, http.StatusTemporaryRedirect)
+
+	if _, rest := splitShortPath(req); rest != "" && (!url.PathPassthrough || !validPassthroughPath(rest)) {
+		http.Error(w, "URL not found", http.StatusNotFound)
+		return
+	}
+
+	if url.Paused() {
+		h.servePaused(w)
+		return
+	}
+
+	if url.DisabledAt != nil || h.blocklist.BlocksLink(&url) {
+		renderBlockedPage(w, url.LongUrl)
+		return
+	}
+
+	now := time.Now()
+	if url.Expired(now) || url.Exhausted() {
+		serveExpired(w, req, &url)
+		return
+	}
+
+	if url.NotStarted(now) {
+		renderNotYetAvailable(w, *url.StartsAt)
+		return
+	}
+	url.LongUrl = url.currentLongUrl(now)
+
+	if url.AccessPasswordHash != "" && !h.checkLinkPassword(w, req, &url) {
+		return
+	}
+
+	destination, variant := chooseDestination(w, req, &url)
+	destination, err = finalDestination(req, &url, destination)
+	if err != nil {
+		http.Error(w, "Error resolving URL", http.StatusInternalServerError)
+		log.Println("Error building destination for URL", url.ID, ":", err)
+		return
+	}
+
+	if h.blocklist.Blocked(destination) {
+		renderBlockedPage(w, destination)
+		return
+	}
+
+	// The click is only spent once the visitor is certain to be redirected.
+	if url.MaxClicks > 0 {
+		ok, err := h.urlDb.ConsumeClick(url.ID)
+		if err != nil {
+			http.Error(w, "Error resolving URL", http.StatusInternalServerError)
+			log.Println("Error consuming click for URL", url.ID, ":", err)
+			return
+		}
+		if !ok {
+			serveExpired(w, req, &url)
+			return
+		}
+	}
+
+	h.clicks.Record(&url, req, variant)
+
+	status := url.redirectStatus()
+	if req.Method == http.MethodPost {
+		// Answering the password form must not replay the POST at the destination.
+		status = http.StatusSeeOther
+	}
+	writeRedirectHeaders(w, &url, now)
+	http.Redirect(w, req, destination, status)
+}
+
+func serveExpired(w http.ResponseWriter, req *http.Request, url *Url) {
+	if url.FallbackUrl != "" {
+		http.Redirect(w, req, url.FallbackUrl, http.StatusTemporaryRedirect)
+		return
+	}
+	http.Error(w, "URL has expired", http.StatusGone)
 }
 
 func (h *authHandler) RegisterUser(w http.ResponseWriter, req *http.Request) {
@@ -144,6 +325,21 @@ func (h *apiHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		case urlsPathWithIdRegEx.MatchString(resourcePath):
 			h.GetUrl(w, req)
 			return
+		case urlStatsPathRegEx.MatchString(resourcePath):
+			h.GetUrlStats(w, req)
+			return
+		case urlQRPathRegEx.MatchString(resourcePath):
+			h.GetUrlQR(w, req)
+			return
+		case urlAliasesPathRegEx.MatchString(resourcePath):
+			h.ListAliases(w, req)
+			return
+		case domainsPathRegEx.MatchString(resourcePath):
+			h.ListDomains(w, req)
+			return
+		case adminCachePathRegEx.MatchString(resourcePath):
+			h.GetCacheStats(w, req)
+			return
 		default:
 			http.Error(w, "Not Found", http.StatusNotFound)
 			return
@@ -153,6 +349,21 @@ func (h *apiHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		case urlsPathRegEx.MatchString(resourcePath):
 			h.CreateUrl(w, req)
 			return
+		case urlAliasesPathRegEx.MatchString(resourcePath):
+			h.AddAlias(w, req)
+			return
+		case urlPausePathRegEx.MatchString(resourcePath):
+			h.PauseUrl(w, req)
+			return
+		case urlResumePathRegEx.MatchString(resourcePath):
+			h.ResumeUrl(w, req)
+			return
+		case domainsPathRegEx.MatchString(resourcePath):
+			h.CreateDomain(w, req)
+			return
+		case domainVerifyPathRegEx.MatchString(resourcePath):
+			h.VerifyDomain(w, req)
+			return
 		default:
 			http.Error(w, "Not Found", http.StatusNotFound)
 			return
@@ -165,6 +376,12 @@ func (h *apiHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		case urlsPathWithIdRegEx.MatchString(resourcePath):
 			h.DeleteUrl(w, req)
 			return
+		case urlAliasPathWithIdRegEx.MatchString(resourcePath):
+			h.RemoveAlias(w, req)
+			return
+		case domainsPathWithIdRegEx.MatchString(resourcePath):
+			h.DeleteDomain(w, req)
+			return
 		default:
 			http.Error(w, "Not Found", http.StatusNotFound)
 			return
@@ -174,6 +391,9 @@ func (h *apiHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		case usersPathWithIdRegEx.MatchString(resourcePath):
 			h.UpdateUser(w, req)
 			return
+		case userSettingsPathRegEx.MatchString(resourcePath):
+			h.UpdateUserSettings(w, req)
+			return
 		case urlsPathWithIdRegEx.MatchString(resourcePath):
 			h.UpdateUrl(w, req)
 			return
@@ -187,12 +407,85 @@ func (h *apiHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (h *apiHandler) CreateUrl(w http.ResponseWriter, req *http.Request) {
-	var requestData struct {
-		ShortUrl string `json:"short_url"`
-		LongUrl  string `json:"long_url"`
+// findDuplicateUrl looks up a live link of the user that already points at
+// the requested destination when dedup is enabled, either by the request or
+// by the user's dedupe_links setting. Only links with the same settings as
+// the request match, and a requested short code that differs from the
+// existing link's disables the match.
+func (h *apiHandler) findDuplicateUrl(r *urlRequest, userId string) (*Url, bool, error) {
+	dedupe := false
+	if r.Dedupe != nil {
+		dedupe = *r.Dedupe
+	} else {
+		user, err := h.userDb.GetById(userId)
+		if err != nil {
+			return nil, false, err
+		}
+		dedupe = user.DedupeLinks
+	}
+	if !dedupe {
+		return nil, false, nil
+	}
+
+	candidates, err := h.urlDb.ListByLongURL(userId, r.domainOrDefault(), r.LongUrl)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	for i := range candidates {
+		existing := &candidates[i]
+		if existing.Expired(now) || existing.Exhausted() {
+			continue
+		}
+		if r.ShortUrl != "" && r.ShortUrl != existing.ShortUrl {
+			continue
+		}
+		if r.matches(existing) {
+			return existing, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// matches reports whether a link created from the request would behave like
+// existing, apart from its short code.
+func (r *urlRequest) matches(existing *Url) bool {
+	sameTime := func(a, b *time.Time) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return a.Equal(*b)
 	}
 
+	if !sameTime(r.StartsAt, existing.StartsAt) || !sameTime(r.ExpiresAt, existing.ExpiresAt) {
+		return false
+	}
+	if r.FallbackUrl != existing.FallbackUrl || r.MaxClicks != existing.MaxClicks ||
+		r.RedirectStatus != existing.RedirectStatus || r.CacheMaxAge != existing.CacheMaxAge ||
+		r.ReferrerPolicy != existing.ReferrerPolicy || r.ForwardQuery != existing.ForwardQuery ||
+		r.PathPassthrough != existing.PathPassthrough || r.UTM != existing.UTM {
+		return false
+	}
+	if !slices.Equal(r.TargetingRules, existing.TargetingRules) || !slices.Equal(r.Variants, existing.Variants) {
+		return false
+	}
+	sameChange := func(a, b ScheduledDestination) bool {
+		return a.At.Equal(b.At) && a.Destination == b.Destination
+	}
+	if !slices.EqualFunc(r.ScheduledDestinations, existing.ScheduledDestinations, sameChange) {
+		return false
+	}
+
+	if r.AccessPassword == nil || *r.AccessPassword == "" {
+		return existing.AccessPasswordHash == ""
+	}
+	return existing.AccessPasswordHash != "" && VerifyPassword(existing.AccessPasswordHash, *r.AccessPassword) == nil
+}
+
+func (h *apiHandler) CreateUrl(w http.ResponseWriter, req *http.Request) {
+	var requestData urlRequest
+
 	userIDFromCtx := GetUserIDFromCtx(req)
 
 	if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
@@ -200,28 +493,107 @@ func (h *apiHandler) CreateUrl(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if err := requestData.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.destinations.canonicalizeRequest(&requestData); err != nil {
+		writeDestinationError(w, err)
+		return
+	}
+
+	if err := h.checkLinkDomain(requestData.domainOrDefault(), userIDFromCtx); err != nil {
+		writeLinkDomainError(w, err)
+		return
+	}
+
+	if requestData.ShortUrl != "" {
+		if err := h.checkShortCode(requestData.ShortUrl, requestData.OverrideReserved, userIDFromCtx); err != nil {
+			writeShortCodeError(w, err)
+			return
+		}
+	}
+
+	existing, found, err := h.findDuplicateUrl(&requestData, userIDFromCtx)
+	if err != nil {
+		http.Error(w, "Error creating URL", http.StatusInternalServerError)
+		log.Println("Error looking up duplicate URL for user", userIDFromCtx, ":", err)
+		return
+	}
+	if found {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(existing)
+		return
+	}
+
 	entry := &Url{
-		ID:       uuid.NewString(),
-		ShortUrl: requestData.ShortUrl,
-		LongUrl:  requestData.LongUrl,
-		UserId:   userIDFromCtx,
+		ID:     uuid.NewString(),
+		UserId: userIDFromCtx,
+	}
+	if err := requestData.apply(entry); err != nil {
+		http.Error(w, "Error creating URL", http.StatusInternalServerError)
+		log.Println("Error creating URL for user", userIDFromCtx, ":", err)
+		return
 	}
 
-	if err := h.urlDb.Add(entry); err != nil {
+	if entry.ShortUrl == "" {
+		err = h.addWithGeneratedCode(entry)
+	} else {
+		err = h.urlDb.Add(entry)
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			http.Error(w, "Short URL already in use", http.StatusConflict)
+			return
+		}
 		http.Error(w, "Error creating URL", http.StatusInternalServerError)
 		log.Println("Error creating URL for user", userIDFromCtx, ":", err)
 		return
 	}
 
+	h.reputation.Submit(entry)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(entry)
 }
 
+// addWithGeneratedCode assigns a generated short code to entry and stores it,
+// retrying with a fresh code when the previous one is already taken.
+func (h *apiHandler) addWithGeneratedCode(entry *Url) error {
+	for range maxShortCodeAttempts {
+		code, err := h.codeGen.Generate()
+		if err != nil {
+			return err
+		}
+		if h.shortCodes.Check(code) != nil {
+			continue
+		}
+		entry.ShortUrl = code
+
+		err = h.urlDb.Add(entry)
+		if !errors.Is(err, gorm.ErrDuplicatedKey) {
+			return err
+		}
+	}
+	return ErrShortCodeExhausted
+}
+
 func (h *apiHandler) ListUrls(w http.ResponseWriter, req *http.Request) {
 	userIDFromCtx := GetUserIDFromCtx(req)
 
-	urls, err := h.urlDb.List(userIDFromCtx)
+	var urls []Url
+	var err error
+	switch health := req.URL.Query().Get("health"); health {
+	case "":
+		urls, err = h.urlDb.List(userIDFromCtx)
+	case "broken":
+		urls, err = h.urlDb.ListBroken(userIDFromCtx)
+	default:
+		http.Error(w, "health must be broken", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error fetching URLs", http.StatusInternalServerError)
 		log.Println("Error fetching URLs for user", userIDFromCtx, ":", err)
@@ -254,22 +626,307 @@ func (h *apiHandler) GetUrl(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if entry.MaxClicks > 0 {
+		remaining := max(entry.MaxClicks-entry.ClickCount, 0)
+		entry.RemainingClicks = &remaining
+	}
+
+	if entry.Aliases, err = h.urlDb.ListAliases(entry.ID); err != nil {
+		http.Error(w, "Error fetching URL", http.StatusInternalServerError)
+		log.Println("Error fetching aliases of URL", entry.ID, ":", err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(&entry)
 }
 
-func (h *apiHandler) UpdateUrl(w http.ResponseWriter, req *http.Request) {
-	var requestData struct {
-		ShortUrl string `json:"short_url"`
-		LongUrl  string `json:"long_url"`
+func (h *apiHandler) GetUrlStats(w http.ResponseWriter, req *http.Request) {
+	urlID := urlStatsPathRegEx.FindStringSubmatch(req.PathValue("route"))[1]
+
+	_, err := uuid.Parse(urlID)
+	if err != nil {
+		http.Error(w, "Invalid url ID", http.StatusBadRequest)
+		return
+	}
+
+	query := req.URL.Query()
+
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	if interval != "hour" && interval != "day" && interval != "week" {
+		http.Error(w, "Interval must be one of hour, day, week", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	if value := query.Get("to"); value != "" {
+		to, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "Invalid 'to' time, expected RFC3339", http.StatusBadRequest)
+			return
+		}
+	}
+
+	from := to.AddDate(0, 0, -30)
+	if value := query.Get("from"); value != "" {
+		from, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "Invalid 'from' time, expected RFC3339", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !from.Before(to) {
+		http.Error(w, "'from' must be before 'to'", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := h.urlDb.GetByID(urlID)
+	if err != nil {
+		http.Error(w, "Error fetching URL", http.StatusInternalServerError)
+		log.Println("Error fetching URL :", err)
+		return
+	}
+
+	userIDFromCtx := GetUserIDFromCtx(req)
+	if entry.UserId != userIDFromCtx {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	stats, err := h.clickDb.Stats(urlID, from, to, interval, statsTopN)
+	if err != nil {
+		http.Error(w, "Error fetching URL stats", http.StatusInternalServerError)
+		log.Println("Error fetching stats for URL", urlID, ":", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (h *apiHandler) GetUrlQR(w http.ResponseWriter, req *http.Request) {
+	urlID := urlQRPathRegEx.FindStringSubmatch(req.PathValue("route"))[1]
+
+	_, err := uuid.Parse(urlID)
+	if err != nil {
+		http.Error(w, "Invalid url ID", http.StatusBadRequest)
+		return
+	}
+
+	options, err := parseQROptions(req.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid QR options: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, err := h.urlDb.GetByID(urlID)
+	if err != nil {
+		http.Error(w, "Error fetching URL", http.StatusInternalServerError)
+		log.Println("Error fetching URL :", err)
+		return
+	}
+
+	userIDFromCtx := GetUserIDFromCtx(req)
+	if entry.UserId != userIDFromCtx {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	image, contentType, err := renderQRCode(fullShortUrl(req, h.baseURL, &entry), options)
+	if err != nil {
+		http.Error(w, "Error generating QR code", http.StatusInternalServerError)
+		log.Println("Error generating QR code for URL", urlID, ":", err)
+		return
 	}
 
+	w.Header().Set("Content-Type", contentType)
+	w.Write(image)
+}
+
+type aliasRequest struct {
+	Domain           string `json:"domain"`
+	ShortUrl         string `json:"short_url"`
+	OverrideReserved bool   `json:"override_reserved"`
+}
+
+// ownedUrl fetches the link with the given ID and checks that it belongs to
+// the requesting user. It writes the error response itself and reports
+// false when the handler should stop.
+func (h *apiHandler) ownedUrl(w http.ResponseWriter, req *http.Request, urlID string) (Url, bool) {
+	if _, err := uuid.Parse(urlID); err != nil {
+		http.Error(w, "Invalid url ID", http.StatusBadRequest)
+		return Url{}, false
+	}
+
+	entry, err := h.urlDb.GetByID(urlID)
+	if err != nil {
+		http.Error(w, "Error fetching URL", http.StatusInternalServerError)
+		log.Println("Error fetching URL :", err)
+		return Url{}, false
+	}
+
+	if entry.UserId != GetUserIDFromCtx(req) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return Url{}, false
+	}
+	return entry, true
+}
+
+// PauseUrl stops a link from redirecting without deleting it or its
+// analytics.
+func (h *apiHandler) PauseUrl(w http.ResponseWriter, req *http.Request) {
+	h.setUrlPaused(w, req, urlPausePathRegEx.FindStringSubmatch(req.PathValue("route"))[1], true)
+}
+
+func (h *apiHandler) ResumeUrl(w http.ResponseWriter, req *http.Request) {
+	h.setUrlPaused(w, req, urlResumePathRegEx.FindStringSubmatch(req.PathValue("route"))[1], false)
+}
+
+func (h *apiHandler) setUrlPaused(w http.ResponseWriter, req *http.Request, urlID string, paused bool) {
+	entry, ok := h.ownedUrl(w, req, urlID)
+	if !ok {
+		return
+	}
+
+	if entry.Paused() != paused {
+		entry.PausedAt = nil
+		if paused {
+			now := time.Now()
+			entry.PausedAt = &now
+		}
+
+		if err := h.urlDb.SetPaused(entry.ID, entry.PausedAt); err != nil {
+			http.Error(w, "Error updating URL", http.StatusInternalServerError)
+			log.Println("Error updating URL", entry.ID, ":", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&entry)
+}
+
+func (h *apiHandler) ListAliases(w http.ResponseWriter, req *http.Request) {
+	urlID := urlAliasesPathRegEx.FindStringSubmatch(req.PathValue("route"))[1]
+
+	entry, ok := h.ownedUrl(w, req, urlID)
+	if !ok {
+		return
+	}
+
+	aliases, err := h.urlDb.ListAliases(entry.ID)
+	if err != nil {
+		http.Error(w, "Error fetching aliases", http.StatusInternalServerError)
+		log.Println("Error fetching aliases of URL", entry.ID, ":", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases)
+}
+
+func (h *apiHandler) AddAlias(w http.ResponseWriter, req *http.Request) {
+	var requestData aliasRequest
+
+	if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Invalid data", http.StatusBadRequest)
+		return
+	}
+
+	requestData.Domain = normalizeHostname(requestData.Domain)
+	if requestData.ShortUrl == "" {
+		http.Error(w, "short_url is required", http.StatusBadRequest)
+		return
+	}
+
+	urlID := urlAliasesPathRegEx.FindStringSubmatch(req.PathValue("route"))[1]
+
+	entry, ok := h.ownedUrl(w, req, urlID)
+	if !ok {
+		return
+	}
+
+	if err := h.checkLinkDomain(requestData.Domain, entry.UserId); err != nil {
+		writeLinkDomainError(w, err)
+		return
+	}
+
+	if err := h.checkShortCode(requestData.ShortUrl, requestData.OverrideReserved, entry.UserId); err != nil {
+		writeShortCodeError(w, err)
+		return
+	}
+
+	alias := &Alias{
+		ID:       uuid.NewString(),
+		UrlId:    entry.ID,
+		Domain:   requestData.Domain,
+		ShortUrl: requestData.ShortUrl,
+	}
+	if err := h.urlDb.AddAlias(alias); err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			http.Error(w, "Short URL already in use", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Error creating alias", http.StatusInternalServerError)
+		log.Println("Error creating alias for URL", entry.ID, ":", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(alias)
+}
+
+func (h *apiHandler) RemoveAlias(w http.ResponseWriter, req *http.Request) {
+	matches := urlAliasPathWithIdRegEx.FindStringSubmatch(req.PathValue("route"))
+	urlID, aliasID := matches[1], matches[2]
+
+	entry, ok := h.ownedUrl(w, req, urlID)
+	if !ok {
+		return
+	}
+
+	if _, err := uuid.Parse(aliasID); err != nil {
+		http.Error(w, "Invalid alias ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.urlDb.RemoveAlias(entry.ID, aliasID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Alias not found; the primary alias cannot be removed", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error deleting alias", http.StatusInternalServerError)
+		log.Println("Error deleting alias", aliasID, ":", err)
+		return
+	}
+
+	fmt.Fprintln(w, "Alias", aliasID, "deleted successfully")
+}
+
+func (h *apiHandler) UpdateUrl(w http.ResponseWriter, req *http.Request) {
+	var requestData urlRequest
+
 	if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
 		http.Error(w, "Invalid Data", http.StatusBadRequest)
 		log.Println("Error decoding data :", err)
 		return
 	}
 
+	if err := requestData.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.destinations.canonicalizeRequest(&requestData); err != nil {
+		writeDestinationError(w, err)
+		return
+	}
+
 	urlID := strings.TrimPrefix(req.PathValue("route"), "url/")
 
 	_, err := uuid.Parse(urlID)
@@ -293,18 +950,47 @@ func (h *apiHandler) UpdateUrl(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	entry := &Url{
-		ID:       urlID,
-		ShortUrl: requestData.ShortUrl,
-		LongUrl:  requestData.LongUrl,
+	if requestData.Domain == nil {
+		requestData.Domain = &url.Domain
+	}
+	movesDomain := *requestData.Domain != url.Domain
+	if movesDomain {
+		if err := h.checkLinkDomain(*requestData.Domain, userIDFromCtx); err != nil {
+			writeLinkDomainError(w, err)
+			return
+		}
+	}
+
+	if requestData.ShortUrl == "" {
+		requestData.ShortUrl = url.ShortUrl
+	}
+	// The code is checked again in a new namespace too.
+	if movesDomain || requestData.ShortUrl != url.ShortUrl {
+		if err := h.checkShortCode(requestData.ShortUrl, requestData.OverrideReserved, userIDFromCtx); err != nil {
+			writeShortCodeError(w, err)
+			return
+		}
+	}
+
+	entry := &url
+	if err := requestData.apply(entry); err != nil {
+		http.Error(w, "Error updating URL", http.StatusInternalServerError)
+		log.Println("Error updating URL", urlID, ":", err)
+		return
 	}
 
 	if err := h.urlDb.Update(urlID, entry); err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			http.Error(w, "Short URL already in use", http.StatusConflict)
+			return
+		}
 		http.Error(w, "Error updating URL", http.StatusInternalServerError)
 		log.Println("Error updating URL", urlID, ":", err)
 		return
 	}
 
+	h.reputation.Submit(entry)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(entry)
 }
@@ -407,13 +1093,15 @@ func (h *apiHandler) UpdateUser(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	user := &User{
-		ID:           userID,
-		Email:        requestData.Email,
-		PasswordHash: string(hashedPassword),
+	user, err := h.userDb.GetById(userID)
+	if err != nil {
+		http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		return
 	}
+	user.Email = requestData.Email
+	user.PasswordHash = string(hashedPassword)
 
-	if err := h.userDb.Update(userID, user); err != nil {
+	if err := h.userDb.Update(userID, &user); err != nil {
 		http.Error(w, "Error updating user", http.StatusInternalServerError)
 		log.Println("Error updating user", userID, ":", err)
 		return
@@ -423,6 +1111,52 @@ func (h *apiHandler) UpdateUser(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintln(w, "User", userID, "updated successfully")
 }
 
+type userSettingsRequest struct {
+	DedupeLinks *bool `json:"dedupe_links"`
+}
+
+func (h *apiHandler) UpdateUserSettings(w http.ResponseWriter, req *http.Request) {
+	var requestData userSettingsRequest
+
+	if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Invalid data", http.StatusBadRequest)
+		return
+	}
+
+	userID := userSettingsPathRegEx.FindStringSubmatch(req.PathValue("route"))[1]
+
+	_, err := uuid.Parse(userID)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	userIDFromCtx := GetUserIDFromCtx(req)
+	if userIDFromCtx != userID {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.userDb.GetById(userID)
+	if err != nil {
+		http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		return
+	}
+
+	if requestData.DedupeLinks != nil {
+		user.DedupeLinks = *requestData.DedupeLinks
+	}
+
+	if err := h.userDb.Update(userID, &user); err != nil {
+		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		log.Println("Error updating settings of user", userID, ":", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&user)
+}
+
 func (h *apiHandler) DeleteUser(w http.ResponseWriter, req *http.Request) {
 	userID := strings.TrimPrefix(req.PathValue("route"), "user/")
 
@@ -447,3 +1181,248 @@ func (h *apiHandler) DeleteUser(w http.ResponseWriter, req *http.Request) {
 	log.Println("User deleted:", userID)
 	fmt.Fprintln(w, "User", userID, "deleted successfully")
 }
+
+// GetCacheStats reports the hit and miss counters of the redirect cache to
+// admins.
+func (h *apiHandler) GetCacheStats(w http.ResponseWriter, req *http.Request) {
+	userIDFromCtx := GetUserIDFromCtx(req)
+
+	user, err := h.userDb.GetById(userIDFromCtx)
+	if err != nil {
+		http.Error(w, "Error fetching user", http.StatusInternalServerError)
+		log.Println("Error fetching user", userIDFromCtx, ":", err)
+		return
+	}
+	if !user.IsAdmin {
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.urlCache.Stats())
+}
+
+// checkLinkDomain ensures links are only placed on the default domain or on
+// a verified domain owned by the user. Without a default host every request
+// is served from the default domain, so custom domains are refused.
+func (h *apiHandler) checkLinkDomain(hostname, userID string) error {
+	if hostname == "" {
+		return nil
+	}
+	if h.defaultHost == "" {
+		return ErrCustomDomainsDisabled
+	}
+
+	domain, err := h.domainDb.GetVerifiedByHostname(hostname)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrDomainNotOwned
+	}
+	if err != nil {
+		return err
+	}
+
+	if domain.UserId != userID {
+		return ErrDomainNotOwned
+	}
+	return nil
+}
+
+func writeLinkDomainError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrDomainNotOwned) {
+		http.Error(w, "Domain is not a verified domain of this user", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, ErrCustomDomainsDisabled) {
+		http.Error(w, "Custom domains require BASE_URL to be configured", http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Error checking domain", http.StatusInternalServerError)
+	log.Println("Error checking domain :", err)
+}
+
+type domainResponse struct {
+	Domain
+	VerificationRecord string `json:"verification_record"`
+	VerificationValue  string `json:"verification_value"`
+}
+
+func newDomainResponse(domain *Domain) *domainResponse {
+	return &domainResponse{
+		Domain:             *domain,
+		VerificationRecord: domainVerificationRecord(domain),
+		VerificationValue:  domainVerificationValue + domain.VerificationToken,
+	}
+}
+
+func (h *apiHandler) CreateDomain(w http.ResponseWriter, req *http.Request) {
+	var requestData struct {
+		Hostname string `json:"hostname"`
+	}
+
+	userIDFromCtx := GetUserIDFromCtx(req)
+
+	if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Invalid data", http.StatusBadRequest)
+		return
+	}
+
+	if h.defaultHost == "" {
+		http.Error(w, "Custom domains require BASE_URL to be configured", http.StatusBadRequest)
+		return
+	}
+
+	hostname := normalizeHostname(requestData.Hostname)
+	if !hostnameRegEx.MatchString(hostname) {
+		http.Error(w, "Incorrect hostname format", http.StatusBadRequest)
+		return
+	}
+	if hostname == h.defaultHost {
+		http.Error(w, "Hostname is already served by default", http.StatusBadRequest)
+		return
+	}
+
+	_, err := h.domainDb.GetVerifiedByHostname(hostname)
+	if err == nil {
+		http.Error(w, "Domain already registered", http.StatusConflict)
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Error creating domain", http.StatusInternalServerError)
+		log.Println("Error looking up domain", hostname, ":", err)
+		return
+	}
+
+	entry := &Domain{
+		ID:                uuid.NewString(),
+		Hostname:          hostname,
+		UserId:            userIDFromCtx,
+		VerificationToken: uuid.NewString(),
+	}
+
+	if err := h.domainDb.Add(entry); err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			http.Error(w, "Domain already registered", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Error creating domain", http.StatusInternalServerError)
+		log.Println("Error creating domain for user", userIDFromCtx, ":", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newDomainResponse(entry))
+}
+
+func (h *apiHandler) ListDomains(w http.ResponseWriter, req *http.Request) {
+	userIDFromCtx := GetUserIDFromCtx(req)
+
+	domains, err := h.domainDb.List(userIDFromCtx)
+	if err != nil {
+		http.Error(w, "Error fetching domains", http.StatusInternalServerError)
+		log.Println("Error fetching domains for user", userIDFromCtx, ":", err)
+		return
+	}
+
+	response := make([]*domainResponse, 0, len(domains))
+	for i := range domains {
+		response = append(response, newDomainResponse(&domains[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *apiHandler) VerifyDomain(w http.ResponseWriter, req *http.Request) {
+	domainID := domainVerifyPathRegEx.FindStringSubmatch(req.PathValue("route"))[1]
+
+	_, err := uuid.Parse(domainID)
+	if err != nil {
+		http.Error(w, "Invalid domain ID", http.StatusBadRequest)
+		return
+	}
+
+	domain, err := h.domainDb.GetByID(domainID)
+	if err != nil {
+		http.Error(w, "Error fetching domain", http.StatusInternalServerError)
+		log.Println("Error fetching domain", domainID, ":", err)
+		return
+	}
+
+	userIDFromCtx := GetUserIDFromCtx(req)
+	if domain.UserId != userIDFromCtx {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if domain.VerifiedAt == nil {
+		if err := verifyDomainOwnership(req.Context(), h.resolver, &domain); err != nil {
+			message := fmt.Sprintf("Domain ownership could not be verified: TXT record %s must contain %s",
+				domainVerificationRecord(&domain), domainVerificationValue+domain.VerificationToken)
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+
+		verifiedAt := time.Now()
+		if err := h.domainDb.MarkVerified(domainID, verifiedAt); err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				http.Error(w, "Domain already verified by another user", http.StatusConflict)
+				return
+			}
+			http.Error(w, "Error verifying domain", http.StatusInternalServerError)
+			log.Println("Error verifying domain", domainID, ":", err)
+			return
+		}
+		domain.VerifiedAt = &verifiedAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newDomainResponse(&domain))
+}
+
+func (h *apiHandler) DeleteDomain(w http.ResponseWriter, req *http.Request) {
+	domainID := strings.TrimPrefix(req.PathValue("route"), "domain/")
+
+	_, err := uuid.Parse(domainID)
+	if err != nil {
+		http.Error(w, "Invalid domain ID", http.StatusBadRequest)
+		return
+	}
+
+	domain, err := h.domainDb.GetByID(domainID)
+	if err != nil {
+		http.Error(w, "Error fetching domain", http.StatusInternalServerError)
+		log.Println("Error fetching domain", domainID, ":", err)
+		return
+	}
+
+	userIDFromCtx := GetUserIDFromCtx(req)
+	if domain.UserId != userIDFromCtx {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Links are only created on verified claims; a pending claim of a
+	// hostname someone else verified does not own them.
+	if domain.VerifiedAt != nil {
+		count, err := h.domainDb.CountUrls(domain.Hostname)
+		if err != nil {
+			http.Error(w, "Error deleting domain", http.StatusInternalServerError)
+			log.Println("Error counting URLs of domain", domainID, ":", err)
+			return
+		}
+		if count > 0 {
+			http.Error(w, "Domain still has URLs", http.StatusConflict)
+			return
+		}
+	}
+
+	if err := h.domainDb.Remove(domainID); err != nil {
+		http.Error(w, "Error deleting domain", http.StatusInternalServerError)
+		log.Println("Error deleting domain", domainID, ":", err)
+		return
+	}
+
+	log.Println("Domain deleted:", domainID)
+	fmt.Fprintln(w, "Domain", domainID, "deleted successfully")
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 6 * time.Hour
+	defaultHealthChecksPerHost = 2
+	healthSweepInterval        = time.Minute
+	healthSweepBatchSize       = 500
+	maxConcurrentHealthChecks  = 32
+	healthProbeTimeout         = 10 * time.Second
+	healthBackoffBase          = time.Minute
+	healthBackoffMax           = 6 * time.Hour
+	healthProbeUserAgent       = "go_url_shortner-health-checker/1.0"
+)
+
+var errNonPublicAddress = errors.New("destination address is not public")
+
+// nonPublicPrefixes are special-purpose ranges not covered by the netip.Addr
+// predicates used in checkPublicAddress.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// checkPublicAddress is a net.Dialer Control function that refuses to
+// connect to loopback, private, link-local, unspecified and other
+// non-public addresses. It runs after name resolution, for every connection
+// and so for every redirect hop, which keeps user-supplied destinations from
+// reaching the internal network.
+func checkPublicAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return errNonPublicAddress
+	}
+
+	addr := addrPort.Addr().Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return errNonPublicAddress
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return errNonPublicAddress
+		}
+	}
+	return nil
+}
+
+// newHealthProbeClient returns a client that only connects to public
+// addresses and never goes through a proxy, which would bypass that check.
+func newHealthProbeClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: healthProbeTimeout,
+		Control: checkPublicAddress,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Timeout: healthProbeTimeout, Transport: transport}
+}
+
+// healthErrorMessage describes a failed probe for the link's owner without
+// the underlying error text, which would reveal details of the network the
+// checker runs in.
+func healthErrorMessage(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNonPublicAddress):
+		return "destination address is not public"
+	case errors.As(err, &dnsErr):
+		return "host could not be resolved"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "request timed out"
+	default:
+		return "destination could not be reached"
+	}
+}
+
+// hostHealth limits how many probes run against one host at a time and
+// backs off from hosts that fail or ask to slow down.
+type hostHealth struct {
+	slots        chan struct{}
+	failures     int
+	backoffUntil time.Time
+}
+
+// healthChecker periodically probes the destinations of links and records
+// the outcome on them.
+type healthChecker struct {
+	store    urlStore
+	lock     exclusiveRunner
+	client   *http.Client
+	interval time.Duration
+	perHost  int
+	slots    chan struct{}
+	cursor   string
+
+	mu    sync.Mutex
+	hosts map[string]*hostHealth
+}
+
+// healthCheckerFromEnv reads HEALTH_CHECK_INTERVAL, how long a result stays
+// fresh before the link is probed again, and HEALTH_CHECKS_PER_HOST, the
+// number of concurrent probes allowed against one host.
+func healthCheckerFromEnv(store urlStore, lock exclusiveRunner) *healthChecker {
+	interval := defaultHealthCheckInterval
+	if value := os.Getenv("HEALTH_CHECK_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			interval = parsed
+		} else {
+			log.Println("Ignoring invalid HEALTH_CHECK_INTERVAL:", value)
+		}
+	}
+
+	perHost := defaultHealthChecksPerHost
+	if value := os.Getenv("HEALTH_CHECKS_PER_HOST"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			perHost = parsed
+		} else {
+			log.Println("Ignoring invalid HEALTH_CHECKS_PER_HOST:", value)
+		}
+	}
+
+	return &healthChecker{
+		store:    store,
+		lock:     lock,
+		client:   newHealthProbeClient(),
+		interval: interval,
+		perHost:  perHost,
+		slots:    make(chan struct{}, maxConcurrentHealthChecks),
+		hosts:    make(map[string]*hostHealth),
+	}
+}
+
+// run probes links whose last check is older than the check interval, one
+// batch per sweep, until ctx is cancelled. Batches walk the links in ID
+// order so links skipped while their host backs off do not hold up the rest.
+// Only one instance sweeps at a time, so every link is probed once and the
+// per-host limits hold across all instances.
+func (c *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(healthSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			_, err := c.lock.TryRun(healthSweepLockKey, func() {
+				c.sweepDue(ctx, now)
+			})
+			if err != nil {
+				log.Println("Error locking health check sweep:", err)
+			}
+		}
+	}
+}
+
+func (c *healthChecker) sweepDue(ctx context.Context, now time.Time) {
+	links, err := c.store.ListForHealthCheck(now.Add(-c.interval), c.cursor, healthSweepBatchSize)
+	if err != nil {
+		log.Println("Error listing URLs for health checks:", err)
+		return
+	}
+	if len(links) < healthSweepBatchSize {
+		c.cursor = ""
+	} else {
+		c.cursor = links[len(links)-1].ID
+	}
+	c.sweep(ctx, links)
+}
+
+func (c *healthChecker) sweep(ctx context.Context, links []Url) {
+	c.pruneHosts(time.Now())
+
+	var wg sync.WaitGroup
+	for _, link := range links {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.checkLink(ctx, &link)
+		}()
+	}
+	wg.Wait()
+}
+
+// pruneHosts forgets hosts that are neither backed off nor being probed.
+func (c *healthChecker) pruneHosts(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, host := range c.hosts {
+		if len(host.slots) == 0 && !now.Before(host.backoffUntil) {
+			delete(c.hosts, name)
+		}
+	}
+}
+
+func (c *healthChecker) host(name string) *hostHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	host, ok := c.hosts[name]
+	if !ok {
+		host = &hostHealth{slots: make(chan struct{}, c.perHost)}
+		c.hosts[name] = host
+	}
+	return host
+}
+
+// checkLink waits for a free slot on the link's host, then for a global
+// slot, and skips the link while its host is backed off.
+func (c *healthChecker) checkLink(ctx context.Context, link *Url) {
+	target, err := url.Parse(link.LongUrl)
+	if err != nil || target.Host == "" {
+		return
+	}
+
+	host := c.host(normalizeHostname(target.Hostname()))
+	select {
+	case host.slots <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	defer func() { <-host.slots }()
+
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	defer func() { <-c.slots }()
+
+	if c.backingOff(host, time.Now()) {
+		return
+	}
+
+	status, latency, probeErr := c.probe(ctx, link.LongUrl)
+	if ctx.Err() != nil {
+		return
+	}
+	c.recordHostResult(host, status, probeErr)
+	if status == http.StatusTooManyRequests {
+		// Rate limiting says nothing about the destination; retry later.
+		return
+	}
+
+	checkedAt := time.Now()
+	errorMessage := ""
+	if probeErr != nil {
+		errorMessage = healthErrorMessage(probeErr)
+	}
+	if err := c.store.RecordHealth(link.ID, status, latency, errorMessage, checkedAt); err != nil {
+		log.Println("Error recording health of URL", link.ID, ":", err)
+	}
+}
+
+// probe requests destination with HEAD and falls back to GET when the server
+// does not support HEAD or the request fails. It returns the final status
+// after redirects and how long the answering request took.
+func (c *healthChecker) probe(ctx context.Context, destination string) (int, time.Duration, error) {
+	status, latency, err := c.request(ctx, http.MethodHead, destination)
+	if err == nil && status != http.StatusMethodNotAllowed && status != http.StatusNotImplemented {
+		return status, latency, nil
+	}
+	return c.request(ctx, http.MethodGet, destination)
+}
+
+func (c *healthChecker) request(ctx context.Context, method, destination string) (int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, method, destination, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", healthProbeUserAgent)
+
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		return 0, latency, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	return resp.StatusCode, latency, nil
+}
+
+func (c *healthChecker) backingOff(host *hostHealth, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return now.Before(host.backoffUntil)
+}
+
+// recordHostResult doubles the host's backoff after every failed probe, up
+// to healthBackoffMax, and clears it once the host answers normally again.
+func (c *healthChecker) recordHostResult(host *hostHealth, status int, probeErr error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if probeErr == nil && status != http.StatusTooManyRequests && status < 500 {
+		host.failures = 0
+		host.backoffUntil = time.Time{}
+		return
+	}
+
+	backoff := healthBackoffBase << min(host.failures, 16)
+	if backoff > healthBackoffMax {
+		backoff = healthBackoffMax
+	}
+	host.failures++
+	host.backoffUntil = time.Now().Add(backoff)
+}
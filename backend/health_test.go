@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckPublicAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.215.14:443", true},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", true},
+		{"127.0.0.1:80", false},
+		{"10.0.0.5:22", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"0.0.0.0:80", false},
+		{"[::1]:80", false},
+		{"[fe80::1]:80", false},
+		{"[fd00::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+	}
+
+	for _, tt := range tests {
+		err := checkPublicAddress("tcp", tt.address, nil)
+		if public := err == nil; public != tt.public {
+			t.Errorf("checkPublicAddress(%q) = %v, want public %v", tt.address, err, tt.public)
+		}
+	}
+}
+
+func TestHealthProbeRefusesInternalDestinations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	checker := &healthChecker{client: newHealthProbeClient()}
+	status, _, err := checker.probe(context.Background(), server.URL)
+	if !errors.Is(err, errNonPublicAddress) {
+		t.Fatalf("probe of %s = %d, %v; want errNonPublicAddress", server.URL, status, err)
+	}
+	if got := healthErrorMessage(err); got != "destination address is not public" {
+		t.Errorf("healthErrorMessage = %q", got)
+	}
+}
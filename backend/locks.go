@@ -0,0 +1,44 @@
+package main
+
+import (
+	"gorm.io/gorm"
+)
+
+// Keys of the Postgres advisory locks that keep background sweeps to one
+// instance at a time.
+const (
+	healthSweepLockKey       int64 = 0x75726c0001
+	reputationRecheckLockKey int64 = 0x75726c0002
+)
+
+// exclusiveRunner runs work that only one instance may do at a time.
+type exclusiveRunner interface {
+	// TryRun runs fn unless another instance is running work under key, and
+	// reports whether fn ran.
+	TryRun(key int64, fn func()) (bool, error)
+}
+
+// advisoryLock implements exclusiveRunner with a session-level Postgres
+// advisory lock, held on one pinned connection while fn runs. Postgres drops
+// the lock when that connection goes away, so a crashed instance cannot
+// keep it.
+type advisoryLock struct {
+	db *gorm.DB
+}
+
+func (l *advisoryLock) TryRun(key int64, fn func()) (bool, error) {
+	locked := false
+	err := l.db.Connection(func(conn *gorm.DB) error {
+		if err := conn.Raw("SELECT pg_try_advisory_lock(?)", key).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+		defer conn.Exec("SELECT pg_advisory_unlock(?)", key)
+
+		fn()
+		return nil
+	})
+	return locked, err
+}
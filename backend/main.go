@@ -4,10 +4,14 @@ import (
 	"context"
 	"errors"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,11 +19,27 @@ import (
 )
 
 type apiHandler struct {
-	urlDb  urlStore
-	userDb userStore
+	urlDb        urlStore
+	userDb       userStore
+	clickDb      clickStore
+	domainDb     domainStore
+	codeGen      *shortCodeGenerator
+	shortCodes   *shortCodePolicy
+	reputation   *reputationMonitor
+	destinations *destinationPolicy
+	resolver     txtResolver
+	urlCache     *cachedUrlStore
+	baseURL      string
+	defaultHost  string
 }
 type shortUrlHandler struct {
-	urlDb urlStore
+	urlDb            urlStore
+	defaultHost      string
+	clicks           *clickRecorder
+	linkSecret       []byte
+	passwordFailures *failureLimiter
+	blocklist        *blocklist
+	pausedPage       []byte
 }
 
 type authHandler struct {
@@ -27,11 +47,24 @@ type authHandler struct {
 }
 
 var (
-	usersPathRegEx       = regexp.MustCompile(`^user\/*$`)
-	usersPathWithIdRegEx = regexp.MustCompile(`^user\/([a-z0-9-]+)$`)
-	urlsPathRegEx        = regexp.MustCompile(`^url\/*$`)
-	urlsPathWithIdRegEx  = regexp.MustCompile(`^url\/([a-z0-9-]+)$`)
-	emailRegEx           = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+	usersPathRegEx          = regexp.MustCompile(`^user\/*$`)
+	usersPathWithIdRegEx    = regexp.MustCompile(`^user\/([a-z0-9-]+)$`)
+	userSettingsPathRegEx   = regexp.MustCompile(`^user\/([a-z0-9-]+)\/settings$`)
+	urlsPathRegEx           = regexp.MustCompile(`^url\/*$`)
+	urlsPathWithIdRegEx     = regexp.MustCompile(`^url\/([a-z0-9-]+)$`)
+	urlStatsPathRegEx       = regexp.MustCompile(`^url\/([a-z0-9-]+)\/stats$`)
+	urlQRPathRegEx          = regexp.MustCompile(`^url\/([a-z0-9-]+)\/qr$`)
+	urlPausePathRegEx       = regexp.MustCompile(`^url\/([a-z0-9-]+)\/pause$`)
+	urlResumePathRegEx      = regexp.MustCompile(`^url\/([a-z0-9-]+)\/resume$`)
+	urlAliasesPathRegEx     = regexp.MustCompile(`^url\/([a-z0-9-]+)\/alias\/*$`)
+	urlAliasPathWithIdRegEx = regexp.MustCompile(`^url\/([a-z0-9-]+)\/alias\/([a-z0-9-]+)$`)
+	adminCachePathRegEx     = regexp.MustCompile(`^admin\/cache$`)
+	domainsPathRegEx        = regexp.MustCompile(`^domain\/*$`)
+	domainsPathWithIdRegEx  = regexp.MustCompile(`^domain\/([a-z0-9-]+)$`)
+	domainVerifyPathRegEx   = regexp.MustCompile(`^domain\/([a-z0-9-]+)\/verify$`)
+	hostnameRegEx           = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z][a-z0-9-]{0,61}[a-z0-9]$`)
+	variantNameRegEx        = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+	emailRegEx              = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
 )
 
 func authMiddleware(authService authService) func(http.Handler) http.Handler {
@@ -87,13 +120,36 @@ func main() {
 		log.Fatalln("Error initializing database:", err)
 	}
 
-	db.AutoMigrate(&User{}, &Url{}, &RefreshToken{})
+	if err := dropDomainHostnameConstraint(db); err != nil {
+		log.Fatalln("Error migrating domains:", err)
+	}
+	db.AutoMigrate(&User{}, &Url{}, &RefreshToken{}, &ClickEvent{}, &Domain{}, &Alias{})
+	if err := backfillPrimaryAliases(db); err != nil {
+		log.Fatalln("Error creating primary aliases:", err)
+	}
 
 	port := os.Getenv("PORT")
+	baseURL := strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+	defaultHost := ""
+	if baseURL != "" {
+		parsed, err := url.Parse(baseURL)
+		if err != nil || parsed.Hostname() == "" {
+			log.Fatalln("Invalid BASE_URL:", baseURL)
+		}
+		defaultHost = normalizeHostname(parsed.Hostname())
+	}
 	jwtSecretString := os.Getenv("JWT_SECRET")
+	ipHashSecret := os.Getenv("IP_HASH_SECRET")
+	if ipHashSecret == "" {
+		ipHashSecret = jwtSecretString
+	}
 
 	userStoreImpl := &userStoreImpl{db: db}
-	urlStoreImpl := &urlStoreImpl{db: db}
+	urlCache := cachedUrlStoreFromEnv(&urlStoreImpl{db: db})
+	urls, err := newBloomUrlStore(urlCache)
+	if err != nil {
+		log.Fatalln("Error loading short codes:", err)
+	}
 	authService := &authServiceImpl{
 		userDb:          userStoreImpl,
 		refreshTokenDb:  &refreshTokenStoreImpl{db: db},
@@ -102,29 +158,90 @@ func main() {
 		refreshTokenTTL: 24 * time.Hour,
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go runExpirySweeper(ctx, urlCache, defaultSweepInterval)
+	go listenForUrlChanges(ctx, os.Getenv("DATABASE_URL"), urlCache, urls)
+
+	blocked, err := blocklistFromEnv()
+	if err != nil {
+		log.Fatalln("Error loading blocklist:", err)
+	}
+	go blocked.watch(ctx, blocklistReloadInterval)
+	sweepLock := &advisoryLock{db: db}
+	go healthCheckerFromEnv(urls, sweepLock).run(ctx)
+
+	clickStoreImpl := &clickStoreImpl{db: db}
+	domainStoreImpl := &domainStoreImpl{db: db}
+	clickRecorder := newClickRecorder(clickStoreImpl, []byte(ipHashSecret))
+	clickRecorder.Start()
+	reputation := reputationMonitorFromEnv(urls, userStoreImpl, sweepLock)
+	reputation.Start()
+
 	authHandler := &authHandler{
 		authService: authService,
 	}
+	codeGen, err := shortCodeGeneratorFromEnv()
+	if err != nil {
+		log.Fatalln("Invalid short code settings:", err)
+	}
+	pausedPage, err := pausedPageFromEnv()
+	if err != nil {
+		log.Fatalln("Error loading paused link page:", err)
+	}
 	shortUrlHandler := &shortUrlHandler{
-		urlDb: urlStoreImpl,
+		urlDb:            urls,
+		defaultHost:      defaultHost,
+		clicks:           clickRecorder,
+		linkSecret:       []byte(jwtSecretString),
+		passwordFailures: newFailureLimiter(maxPasswordFailures, passwordFailureReset),
+		blocklist:        blocked,
+		pausedPage:       pausedPage,
 	}
 	apiHandler := &apiHandler{
-		urlDb:  urlStoreImpl,
-		userDb: userStoreImpl,
+		urlDb:        urls,
+		userDb:       userStoreImpl,
+		clickDb:      clickStoreImpl,
+		domainDb:     domainStoreImpl,
+		destinations: destinationPolicyFromEnv(defaultHost, domainStoreImpl, blocked),
+		codeGen:      codeGen,
+		shortCodes:   shortCodePolicyFromEnv(),
+		reputation:   reputation,
+		resolver:     net.DefaultResolver,
+		urlCache:     urlCache,
+		baseURL:      baseURL,
+		defaultHost:  defaultHost,
 	}
 
 	http.Handle("/{short_url}", shortUrlHandler)
+	http.Handle("/{short_url}/{rest...}", shortUrlHandler)
 	http.HandleFunc("POST /api/auth/register", authHandler.RegisterUser)
 	http.HandleFunc("POST /api/auth/login", authHandler.LoginUser)
 	http.HandleFunc("POST /api/auth/refresh", authHandler.RefreshToken)
 	http.Handle("/api/{route...}", authMiddleware(authService)(apiHandler))
 
-	log.Println("Starting application on port", port)
-	err = http.ListenAndServe(":"+port, nil)
+	server := &http.Server{Addr: ":" + port}
+
+	go func() {
+		log.Println("Starting application on port", port)
+		err := server.ListenAndServe()
+
+		if errors.Is(err, http.ErrServerClosed) {
+			log.Println("Server Closed")
+		} else if err != nil {
+			log.Fatalln("Error starting server:", err)
+		}
+	}()
 
-	if errors.Is(err, http.ErrServerClosed) {
-		log.Fatalln("Server Closed")
-	} else if err != nil {
-		log.Fatalln("Error starting server:", err)
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error shutting down server:", err)
 	}
+
+	clickRecorder.Close()
+	reputation.Close()
 }
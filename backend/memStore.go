@@ -12,15 +12,31 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type urlStore interface {
 	Add(entry *Url) error
 	GetByID(urlID string) (Url, error)
-	GetByShortURL(shortUrl string) (Url, error)
+	GetByShortURL(domain, shortUrl string) (Url, error)
+	ListByLongURL(userId, domain, longUrl string) ([]Url, error)
 	Update(urlId string, entry *Url) error
 	List(userToken string) ([]Url, error)
 	Remove(urlId string) error
+	ArchiveExpired(now time.Time) (int64, error)
+	ConsumeClick(urlId string) (bool, error)
+	ListShortURLs() ([]Url, error)
+	ListBroken(userId string) ([]Url, error)
+	ListScheduled() ([]Url, error)
+	ApplyScheduledDestination(urlId, longUrl string, remaining []ScheduledDestination, expectedUpdatedAt time.Time) (bool, error)
+	ListForHealthCheck(checkedBefore time.Time, afterId string, limit int) ([]Url, error)
+	RecordHealth(urlId string, status int, latency time.Duration, errorMessage string, checkedAt time.Time) error
+	ListForReputationCheck(afterId string, limit int) ([]Url, error)
+	SetPaused(urlId string, pausedAt *time.Time) error
+	SetDisabled(urlId string, disabledAt *time.Time, reason string) error
+	AddAlias(alias *Alias) error
+	ListAliases(urlId string) ([]Alias, error)
+	RemoveAlias(urlId, aliasId string) error
 }
 
 type userStore interface {
@@ -37,6 +53,21 @@ type refreshTokenStore interface {
 	RevokeRefreshToken(token *RefreshToken) error
 }
 
+type domainStore interface {
+	Add(entry *Domain) error
+	GetByID(domainId string) (Domain, error)
+	GetVerifiedByHostname(hostname string) (Domain, error)
+	List(userId string) ([]Domain, error)
+	MarkVerified(domainId string, at time.Time) error
+	CountUrls(hostname string) (int64, error)
+	Remove(domainId string) error
+}
+
+type clickStore interface {
+	AddBatch(events []ClickEvent) error
+	Stats(urlId string, from, to time.Time, interval string, topN int) (*UrlStats, error)
+}
+
 type urlStoreImpl struct {
 	db *gorm.DB
 }
@@ -49,9 +80,31 @@ type refreshTokenStoreImpl struct {
 	db *gorm.DB
 }
 
+type domainStoreImpl struct {
+	db *gorm.DB
+}
+
+type clickStoreImpl struct {
+	db *gorm.DB
+}
+
 func (s *urlStoreImpl) Add(entry *Url) error {
-	result := s.db.Create(entry)
-	return result.Error
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(entry).Error; err != nil {
+			return err
+		}
+		primary := &Alias{
+			ID:        uuid.NewString(),
+			UrlId:     entry.ID,
+			Domain:    entry.Domain,
+			ShortUrl:  entry.ShortUrl,
+			IsPrimary: true,
+		}
+		if err := tx.Create(primary).Error; err != nil {
+			return err
+		}
+		return notifyUrlChange(tx, urlChange{ID: entry.ID, Domain: entry.Domain, ShortUrl: entry.ShortUrl})
+	})
 }
 
 func (s *urlStoreImpl) GetByID(urlID string) (Url, error) {
@@ -60,15 +113,46 @@ func (s *urlStoreImpl) GetByID(urlID string) (Url, error) {
 	return entry, result.Error
 }
 
-func (s *urlStoreImpl) GetByShortURL(shortUrl string) (Url, error) {
+// GetByShortURL resolves any alias of a link, primary or not.
+func (s *urlStoreImpl) GetByShortURL(domain, shortUrl string) (Url, error) {
 	var entry Url
-	result := s.db.First(&entry, "short_url = ?", shortUrl)
+	result := s.db.Joins("JOIN aliases ON aliases.url_id = urls.id").
+		First(&entry, "aliases.domain = ? AND aliases.short_url = ?", domain, shortUrl)
 	return entry, result.Error
 }
 
+// ListByLongURL returns the unarchived links of the user on domain that point
+// at longUrl and are neither paused nor disabled, oldest first.
+func (s *urlStoreImpl) ListByLongURL(userId, domain, longUrl string) ([]Url, error) {
+	var urls []Url
+	result := s.db.Order("created_at").
+		Where("archived_at IS NULL AND paused_at IS NULL AND disabled_at IS NULL").
+		Find(&urls, "user_id = ? AND domain = ? AND long_url = ?", userId, domain, longUrl)
+	return urls, result.Error
+}
+
+// urlStateColumns are never written by Update. Redirects, background jobs and
+// the pause endpoints change them through dedicated methods, and writing back
+// a copy of the row read earlier would undo those changes.
+var urlStateColumns = []string{
+	"click_count", "health_status", "health_latency_ms", "health_error", "health_checked_at",
+	"disabled_at", "disabled_reason", "paused_at", "created_at",
+}
+
+// Update stores the editable columns of entry, leaving urlStateColumns alone.
 func (s *urlStoreImpl) Update(shortUrl string, entry *Url) error {
-	result := s.db.Save(entry)
-	return result.Error
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(entry).Select("*").Omit(urlStateColumns...).Updates(entry).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&Alias{}).
+			Where("url_id = ? AND is_primary", entry.ID).
+			Updates(map[string]any{"domain": entry.Domain, "short_url": entry.ShortUrl}).Error
+		if err != nil {
+			return err
+		}
+		return notifyUrlChange(tx, urlChange{ID: entry.ID, Domain: entry.Domain, ShortUrl: entry.ShortUrl})
+	})
 }
 
 func (s *urlStoreImpl) List(user_id string) ([]Url, error) {
@@ -77,13 +161,180 @@ func (s *urlStoreImpl) List(user_id string) ([]Url, error) {
 	return urls, result.Error
 }
 
-func (s *urlStoreImpl) Remove(shortUrl string) error {
-	result := s.db.Delete(&Url{
-		ShortUrl: shortUrl,
+func (s *urlStoreImpl) Remove(urlId string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		entry := &Url{ID: urlId}
+		if err := tx.Clauses(clause.Returning{}).Delete(entry).Error; err != nil {
+			return err
+		}
+		return notifyUrlChange(tx, urlChange{ID: urlId, Domain: entry.Domain, ShortUrl: entry.ShortUrl, Deleted: true})
+	})
+}
+
+func (s *urlStoreImpl) ArchiveExpired(now time.Time) (int64, error) {
+	result := s.db.Model(&Url{}).
+		Where("expires_at <= ? AND archived_at IS NULL", now).
+		Update("archived_at", now)
+	return result.RowsAffected, result.Error
+}
+
+// ConsumeClick atomically counts a click against a click-limited link. It
+// reports false when the link has no clicks left.
+func (s *urlStoreImpl) ConsumeClick(urlId string) (bool, error) {
+	result := s.db.Model(&Url{}).
+		Where("id = ? AND (max_clicks = 0 OR click_count < max_clicks)", urlId).
+		Update("click_count", gorm.Expr("click_count + 1"))
+	return result.RowsAffected == 1, result.Error
+}
+
+// ListShortURLs returns every alias of every link as a Url with only Domain
+// and ShortUrl loaded.
+func (s *urlStoreImpl) ListShortURLs() ([]Url, error) {
+	var urls []Url
+	result := s.db.Table("aliases").Select("domain", "short_url").Find(&urls)
+	return urls, result.Error
+}
+
+func (s *urlStoreImpl) AddAlias(alias *Alias) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(alias).Error; err != nil {
+			return err
+		}
+		return notifyUrlChange(tx, urlChange{ID: alias.UrlId, Domain: alias.Domain, ShortUrl: alias.ShortUrl})
+	})
+}
+
+// ListAliases returns the aliases of a link, the primary one first.
+func (s *urlStoreImpl) ListAliases(urlId string) ([]Alias, error) {
+	var aliases []Alias
+	result := s.db.Order("is_primary DESC, created_at").Find(&aliases, "url_id = ?", urlId)
+	return aliases, result.Error
+}
+
+// RemoveAlias deletes a secondary alias of a link. The primary alias can only
+// go together with the link.
+func (s *urlStoreImpl) RemoveAlias(urlId, aliasId string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		alias := &Alias{}
+		result := tx.Clauses(clause.Returning{}).
+			Where("id = ? AND url_id = ? AND NOT is_primary", aliasId, urlId).
+			Delete(alias)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return notifyUrlChange(tx, urlChange{ID: urlId, Domain: alias.Domain, ShortUrl: alias.ShortUrl, Deleted: true})
+	})
+}
+
+// ListScheduled returns the live links with pending scheduled destination
+// changes.
+func (s *urlStoreImpl) ListScheduled() ([]Url, error) {
+	var urls []Url
+	result := s.db.Where("archived_at IS NULL AND scheduled_destinations IS NOT NULL").
+		Where("scheduled_destinations NOT IN ('null', '[]')").
+		Find(&urls)
+	return urls, result.Error
+}
+
+// ApplyScheduledDestination switches the link to longUrl and keeps only the
+// remaining scheduled changes, unless the link was updated since it was read
+// at expectedUpdatedAt. It reports whether the link was switched.
+func (s *urlStoreImpl) ApplyScheduledDestination(urlId, longUrl string, remaining []ScheduledDestination, expectedUpdatedAt time.Time) (bool, error) {
+	applied := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		entry := &Url{ID: urlId, LongUrl: longUrl, ScheduledDestinations: remaining}
+		result := tx.Model(entry).Clauses(clause.Returning{}).
+			Where("updated_at = ?", expectedUpdatedAt).
+			Select("long_url", "scheduled_destinations", "updated_at").
+			Updates(entry)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		applied = true
+		return notifyUrlChange(tx, urlChange{ID: urlId, Domain: entry.Domain, ShortUrl: entry.ShortUrl})
+	})
+	return applied && err == nil, err
+}
+
+// brokenHealthCondition matches links whose last health check failed to
+// connect or got an error status.
+const brokenHealthCondition = "health_checked_at IS NOT NULL AND (health_status = 0 OR health_status >= 400)"
+
+func (s *urlStoreImpl) ListBroken(userId string) ([]Url, error) {
+	var urls []Url
+	result := s.db.Where(brokenHealthCondition).Find(&urls, "user_id = ?", userId)
+	return urls, result.Error
+}
+
+// ListForHealthCheck returns up to limit live links with an ID after afterId
+// that were not checked since checkedBefore, in ID order, with only ID and
+// LongUrl loaded.
+func (s *urlStoreImpl) ListForHealthCheck(checkedBefore time.Time, afterId string, limit int) ([]Url, error) {
+	var urls []Url
+	result := s.db.Select("id", "long_url").
+		Where("id > ? AND archived_at IS NULL AND disabled_at IS NULL AND paused_at IS NULL", afterId).
+		Where("health_checked_at IS NULL OR health_checked_at < ?", checkedBefore).
+		Order("id").
+		Limit(limit).
+		Find(&urls)
+	return urls, result.Error
+}
+
+// ListForReputationCheck returns up to limit unarchived links with an ID
+// after afterId, in ID order, with only ID loaded.
+func (s *urlStoreImpl) ListForReputationCheck(afterId string, limit int) ([]Url, error) {
+	var urls []Url
+	result := s.db.Select("id").
+		Where("id > ? AND archived_at IS NULL", afterId).
+		Order("id").
+		Limit(limit).
+		Find(&urls)
+	return urls, result.Error
+}
+
+// RecordHealth stores the outcome of a health check. A status of zero means
+// the destination could not be reached.
+func (s *urlStoreImpl) RecordHealth(urlId string, status int, latency time.Duration, errorMessage string, checkedAt time.Time) error {
+	result := s.db.Model(&Url{}).Where("id = ?", urlId).Updates(map[string]any{
+		"health_status":     status,
+		"health_latency_ms": latency.Milliseconds(),
+		"health_error":      errorMessage,
+		"health_checked_at": checkedAt,
 	})
 	return result.Error
 }
 
+// SetPaused pauses the link as of pausedAt, or resumes it when pausedAt is
+// nil.
+func (s *urlStoreImpl) SetPaused(urlId string, pausedAt *time.Time) error {
+	return s.updateState(urlId, map[string]any{"paused_at": pausedAt})
+}
+
+// SetDisabled disables the link as of disabledAt for reason, or enables it
+// again when disabledAt is nil.
+func (s *urlStoreImpl) SetDisabled(urlId string, disabledAt *time.Time, reason string) error {
+	return s.updateState(urlId, map[string]any{"disabled_at": disabledAt, "disabled_reason": reason})
+}
+
+// updateState writes some of the urlStateColumns of a link and tells the
+// other instances that it changed.
+func (s *urlStoreImpl) updateState(urlId string, columns map[string]any) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		entry := &Url{ID: urlId}
+		result := tx.Model(entry).Clauses(clause.Returning{}).Updates(columns)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return notifyUrlChange(tx, urlChange{ID: urlId, Domain: entry.Domain, ShortUrl: entry.ShortUrl})
+	})
+}
+
 func (s *userStoreImpl) Add(email, hashedPassword string) (*User, error) {
 	entry := &User{
 		ID:           uuid.NewString(),
@@ -118,6 +369,49 @@ func (s *userStoreImpl) Remove(userId string) error {
 	return result.Error
 }
 
+func (s *domainStoreImpl) Add(entry *Domain) error {
+	result := s.db.Create(entry)
+	return result.Error
+}
+
+func (s *domainStoreImpl) GetByID(domainId string) (Domain, error) {
+	var entry Domain
+	result := s.db.First(&entry, "id = ?", domainId)
+	return entry, result.Error
+}
+
+// GetVerifiedByHostname returns the verified claim of hostname, ignoring
+// pending claims of other users.
+func (s *domainStoreImpl) GetVerifiedByHostname(hostname string) (Domain, error) {
+	var entry Domain
+	result := s.db.First(&entry, "hostname = ? AND verified_at IS NOT NULL", hostname)
+	return entry, result.Error
+}
+
+func (s *domainStoreImpl) List(userId string) ([]Domain, error) {
+	var domains []Domain
+	result := s.db.Find(&domains, "user_id = ?", userId)
+	return domains, result.Error
+}
+
+func (s *domainStoreImpl) MarkVerified(domainId string, at time.Time) error {
+	result := s.db.Model(&Domain{ID: domainId}).Update("verified_at", at)
+	return result.Error
+}
+
+func (s *domainStoreImpl) CountUrls(hostname string) (int64, error) {
+	var count int64
+	result := s.db.Model(&Alias{}).Where("domain = ?", hostname).Distinct("url_id").Count(&count)
+	return count, result.Error
+}
+
+func (s *domainStoreImpl) Remove(domainId string) error {
+	result := s.db.Delete(&Domain{
+		ID: domainId,
+	})
+	return result.Error
+}
+
 func (s *refreshTokenStoreImpl) GenerateRefreshToken(userId string, ttl time.Duration) (*RefreshToken, error) {
 	tokenId := uuid.NewString()
 	expiresAt := time.Now().Add(ttl)
@@ -151,13 +445,89 @@ func (s *refreshTokenStoreImpl) RevokeRefreshToken(token *RefreshToken) error {
 	return result.Error
 }
 
+func (s *clickStoreImpl) AddBatch(events []ClickEvent) error {
+	result := s.db.CreateInBatches(events, len(events))
+	return result.Error
+}
+
+func (s *clickStoreImpl) Stats(urlId string, from, to time.Time, interval string, topN int) (*UrlStats, error) {
+	stats := &UrlStats{From: from, To: to, Interval: interval}
+	inRange := s.db.Model(&ClickEvent{}).
+		Where("url_id = ? AND clicked_at >= ? AND clicked_at < ?", urlId, from, to)
+
+	result := inRange.Session(&gorm.Session{}).
+		Select("COUNT(*) AS total_clicks, COUNT(DISTINCT ip_hash) AS unique_clicks").
+		Scan(stats)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	result = inRange.Session(&gorm.Session{}).
+		Select("date_trunc(?, clicked_at) AS start, COUNT(*) AS clicks", interval).
+		Group("start").
+		Order("start").
+		Scan(&stats.Buckets)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	top := func(column string, out *[]StatsCount) error {
+		return inRange.Session(&gorm.Session{}).
+			Select(column + " AS value, COUNT(*) AS clicks").
+			Where(column + " <> ''").
+			Group(column).
+			Order("clicks DESC").
+			Limit(topN).
+			Scan(out).Error
+	}
+	if err := top("referrer", &stats.TopReferrers); err != nil {
+		return nil, err
+	}
+	if err := top("country", &stats.TopCountries); err != nil {
+		return nil, err
+	}
+	if err := top("device", &stats.TopDevices); err != nil {
+		return nil, err
+	}
+
+	result = inRange.Session(&gorm.Session{}).
+		Select("variant, COUNT(*) AS clicks, COUNT(DISTINCT ip_hash) AS unique_clicks").
+		Where("variant <> ''").
+		Group("variant").
+		Order("variant").
+		Scan(&stats.Variants)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return stats, nil
+}
+
+// backfillPrimaryAliases gives every link created before aliases existed a
+// primary alias for its short code.
+func backfillPrimaryAliases(db *gorm.DB) error {
+	return db.Exec(`INSERT INTO aliases (id, url_id, domain, short_url, is_primary, created_at)
+		SELECT gen_random_uuid()::text, urls.id, urls.domain, urls.short_url, true, urls.created_at
+		FROM urls
+		WHERE NOT EXISTS (SELECT 1 FROM aliases WHERE aliases.url_id = urls.id)`).Error
+}
+
+// dropDomainHostnameConstraint removes the unique constraint older versions
+// put on domains.hostname, which let a pending claim lock out the owner.
+func dropDomainHostnameConstraint(db *gorm.DB) error {
+	if !db.Migrator().HasConstraint(&Domain{}, "uni_domains_hostname") {
+		return nil
+	}
+	return db.Migrator().DropConstraint(&Domain{}, "uni_domains_hostname")
+}
+
 func initDB() (*gorm.DB, error) {
 	dsn := os.Getenv("DATABASE_URL")
 	if dsn == "" {
 		log.Fatal("DATABASE_URL environment variable is not set")
 	}
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		return nil, err
 	}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type RefreshToken struct {
@@ -17,16 +19,153 @@ type User struct {
 	ID           string    `json:"id" gorm:"primaryKey"`
 	Email        string    `json:"email" gorm:"unique"`
 	PasswordHash string    `json:"password_hash"`
+	DedupeLinks  bool      `json:"dedupe_links" gorm:"default:false"`
+	IsAdmin      bool      `json:"is_admin" gorm:"default:false"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 type Url struct {
+	ID                    string                 `json:"id" gorm:"primaryKey"`
+	Domain                string                 `json:"domain" gorm:"not null;default:'';uniqueIndex:idx_urls_domain_short_url"`
+	ShortUrl              string                 `json:"short_url" gorm:"uniqueIndex:idx_urls_domain_short_url"`
+	LongUrl               string                 `json:"long_url"`
+	UserId                string                 `json:"user_id" gorm:"index"`
+	StartsAt              *time.Time             `json:"starts_at"`
+	ExpiresAt             *time.Time             `json:"expires_at"`
+	FallbackUrl           string                 `json:"fallback_url"`
+	ArchivedAt            *time.Time             `json:"archived_at" gorm:"index"`
+	MaxClicks             int64                  `json:"max_clicks"`
+	ClickCount            int64                  `json:"click_count"`
+	AccessPasswordHash    string                 `json:"-"`
+	RedirectStatus        int                    `json:"redirect_status"`
+	CacheMaxAge           int                    `json:"cache_max_age"`
+	ReferrerPolicy        string                 `json:"referrer_policy"`
+	ForwardQuery          bool                   `json:"forward_query"`
+	PathPassthrough       bool                   `json:"path_passthrough"`
+	TargetingRules        []TargetingRule        `json:"targeting_rules" gorm:"serializer:json;type:jsonb"`
+	Variants              []Variant              `json:"variants" gorm:"serializer:json;type:jsonb"`
+	ScheduledDestinations []ScheduledDestination `json:"scheduled_destinations" gorm:"serializer:json;type:jsonb"`
+	UTM                   UTMParams              `json:"utm" gorm:"embedded;embeddedPrefix:utm_"`
+	DisabledAt            *time.Time             `json:"disabled_at"`
+	DisabledReason        string                 `json:"disabled_reason"`
+	PausedAt              *time.Time             `json:"paused_at"`
+	HealthStatus          int                    `json:"health_status"`
+	HealthLatencyMs       int64                  `json:"health_latency_ms"`
+	HealthError           string                 `json:"health_error"`
+	HealthCheckedAt       *time.Time             `json:"health_checked_at"`
+	CreatedAt             time.Time              `json:"created_at"`
+	UpdatedAt             time.Time              `json:"updated_at"`
+	User                  User                   `gorm:"foreignKey:UserId"`
+
+	PasswordProtected bool    `json:"password_protected" gorm:"-"`
+	RemainingClicks   *int64  `json:"remaining_clicks,omitempty" gorm:"-"`
+	Aliases           []Alias `json:"aliases,omitempty" gorm:"-"`
+}
+
+// Alias is one short code of a link. Every link has exactly one primary
+// alias, whose code is mirrored in Url.Domain and Url.ShortUrl; any number of
+// further aliases redirect to the same link and count towards its stats.
+type Alias struct {
 	ID        string    `json:"id" gorm:"primaryKey"`
-	ShortUrl  string    `json:"short_url" gorm:"unique"`
-	LongUrl   string    `json:"long_url"`
-	UserId    string    `json:"user_id"`
+	UrlId     string    `json:"url_id" gorm:"not null;index"`
+	Domain    string    `json:"domain" gorm:"not null;default:'';uniqueIndex:idx_aliases_domain_short_url"`
+	ShortUrl  string    `json:"short_url" gorm:"not null;uniqueIndex:idx_aliases_domain_short_url"`
+	IsPrimary bool      `json:"primary" gorm:"not null;default:false"`
 	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	User      User      `gorm:"foreignKey:UserId"`
+	Url       Url       `json:"-" gorm:"foreignKey:UrlId;constraint:OnDelete:CASCADE"`
+}
+
+// TargetingRule sends visitors whose User-Agent matches OS and Device, when
+// set, to Destination instead of the link's LongUrl.
+type TargetingRule struct {
+	OS          string `json:"os,omitempty"`
+	Device      string `json:"device,omitempty"`
+	Destination string `json:"destination"`
+}
+
+// Variant is one destination of an A/B split. Visitors are assigned a
+// variant with probability proportional to Weight.
+type Variant struct {
+	Name        string `json:"name"`
+	Destination string `json:"destination"`
+	Weight      int    `json:"weight"`
+}
+
+// ScheduledDestination replaces the link's LongUrl with Destination from At
+// on.
+type ScheduledDestination struct {
+	At          time.Time `json:"at"`
+	Destination string    `json:"destination"`
+}
+
+// AfterFind fills in the fields derived from stored columns.
+func (u *Url) AfterFind(tx *gorm.DB) error {
+	u.PasswordProtected = u.AccessPasswordHash != ""
+	return nil
+}
+
+func (u *Url) Expired(now time.Time) bool {
+	return u.ExpiresAt != nil && !now.Before(*u.ExpiresAt)
+}
+
+// Exhausted reports whether a click-limited link has used up its clicks.
+// A MaxClicks of zero means the link is unlimited.
+func (u *Url) Exhausted() bool {
+	return u.MaxClicks > 0 && u.ClickCount >= u.MaxClicks
+}
+
+// Domain is a custom hostname a user serves short links from. Links can only
+// be created on it once VerifiedAt is set. Several users may claim the same
+// hostname, but only one claim can be verified.
+type Domain struct {
+	ID                string     `json:"id" gorm:"primaryKey"`
+	Hostname          string     `json:"hostname" gorm:"not null;uniqueIndex:idx_domains_hostname_user;uniqueIndex:idx_domains_verified_hostname,where:verified_at IS NOT NULL"`
+	UserId            string     `json:"user_id" gorm:"uniqueIndex:idx_domains_hostname_user"`
+	VerificationToken string     `json:"verification_token"`
+	VerifiedAt        *time.Time `json:"verified_at"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+	User              User       `gorm:"foreignKey:UserId"`
+}
+
+type ClickEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UrlId     string    `json:"url_id" gorm:"index"`
+	ClickedAt time.Time `json:"clicked_at" gorm:"index"`
+	Referrer  string    `json:"referrer"`
+	UserAgent string    `json:"user_agent"`
+	IPHash    string    `json:"ip_hash"`
+	Country   string    `json:"country"`
+	Device    string    `json:"device"`
+	Variant   string    `json:"variant"`
+}
+
+type UrlStats struct {
+	From         time.Time      `json:"from"`
+	To           time.Time      `json:"to"`
+	Interval     string         `json:"interval"`
+	TotalClicks  int64          `json:"total_clicks"`
+	UniqueClicks int64          `json:"unique_clicks"`
+	Buckets      []StatsBucket  `json:"buckets"`
+	TopReferrers []StatsCount   `json:"top_referrers"`
+	TopCountries []StatsCount   `json:"top_countries"`
+	TopDevices   []StatsCount   `json:"top_devices"`
+	Variants     []VariantStats `json:"variants"`
+}
+
+type StatsBucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int64     `json:"clicks"`
+}
+
+type StatsCount struct {
+	Value  string `json:"value"`
+	Clicks int64  `json:"clicks"`
+}
+
+type VariantStats struct {
+	Variant      string `json:"variant"`
+	Clicks       int64  `json:"clicks"`
+	UniqueClicks int64  `json:"unique_clicks"`
 }
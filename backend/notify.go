@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	urlChangesChannel       = "url_changes"
+	listenerMinBackoff      = time.Second
+	listenerMaxBackoff      = 30 * time.Second
+	listenerHealthyDuration = time.Minute
+)
+
+type urlChange struct {
+	ID       string `json:"id"`
+	Domain   string `json:"domain"`
+	ShortUrl string `json:"short_url"`
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+// urlChangeSubscriber keeps local state in sync with links changed by any
+// instance. Resync is called whenever notifications may have been missed.
+type urlChangeSubscriber interface {
+	ApplyChange(change urlChange)
+	Resync()
+}
+
+// notifyUrlChange queues a notification on urlChangesChannel. When tx is a
+// transaction Postgres only delivers it once the transaction commits.
+func notifyUrlChange(tx *gorm.DB, change urlChange) error {
+	payload, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	return tx.Exec("SELECT pg_notify(?, ?)", urlChangesChannel, string(payload)).Error
+}
+
+// listenForUrlChanges forwards link changes reported by any instance to the
+// subscribers. It reconnects with exponential backoff whenever the
+// connection drops and resyncs the subscribers after reconnecting, since
+// notifications sent while disconnected are lost.
+func listenForUrlChanges(ctx context.Context, dsn string, subscribers ...urlChangeSubscriber) {
+	backoff := listenerMinBackoff
+
+	for ctx.Err() == nil {
+		started := time.Now()
+		err := listenOnce(ctx, dsn, subscribers)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > listenerHealthyDuration {
+			backoff = listenerMinBackoff
+		}
+		log.Println("URL change listener disconnected, retrying in", backoff, ":", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, listenerMaxBackoff)
+	}
+}
+
+func listenOnce(ctx context.Context, dsn string, subscribers []urlChangeSubscriber) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+urlChangesChannel); err != nil {
+		return err
+	}
+	for _, subscriber := range subscribers {
+		subscriber.Resync()
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var change urlChange
+		if err := json.Unmarshal([]byte(notification.Payload), &change); err != nil {
+			log.Println("Ignoring malformed URL change notification:", err)
+			continue
+		}
+
+		for _, subscriber := range subscribers {
+			subscriber.ApplyChange(change)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// pausedPageFromEnv reads the holding page served for paused links from the
+// HTML file named by PAUSED_LINK_PAGE. Without it paused links answer 404.
+func pausedPageFromEnv() ([]byte, error) {
+	path := os.Getenv("PAUSED_LINK_PAGE")
+	if path == "" {
+		return nil, nil
+	}
+	return os.ReadFile(path)
+}
+
+// Paused reports whether the owner has paused the link. Paused links keep
+// their codes and analytics but do not redirect.
+func (u *Url) Paused() bool {
+	return u.PausedAt != nil
+}
+
+func (h *shortUrlHandler) servePaused(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	if h.pausedPage == nil {
+		http.Error(w, "URL not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(h.pausedPage)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	linkAccessCookieTTL  = time.Hour
+	maxPasswordFailures  = 5
+	passwordFailureReset = 15 * time.Minute
+)
+
+var passwordFormTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Password required</title>
+</head>
+<body>
+	<h1>This link is password protected</h1>
+	{{if .Error}}<p style="color: #b00020">{{.Error}}</p>{{end}}
+	<form method="POST">
+		<label for="password">Password</label>
+		<input id="password" name="password" type="password" autofocus required>
+		<button type="submit">Continue</button>
+	</form>
+</body>
+</html>
+`))
+
+func renderPasswordForm(w http.ResponseWriter, status int, errorMessage string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	passwordFormTemplate.Execute(w, struct{ Error string }{errorMessage})
+}
+
+func linkAccessCookieName(url *Url) string {
+	return "link_access_" + url.ID
+}
+
+// signLinkAccess produces a cookie value that grants access to url until
+// expiresAt. The password hash is part of the signature so changing the
+// password invalidates every cookie issued for the old one.
+func signLinkAccess(secret []byte, url *Url, expiresAt time.Time) string {
+	payload := url.ID + "|" + strconv.FormatInt(expiresAt.Unix(), 10)
+	return payload + "|" + linkAccessSignature(secret, payload, url.AccessPasswordHash)
+}
+
+func verifyLinkAccess(secret []byte, url *Url, value string, now time.Time) bool {
+	parts := strings.Split(value, "|")
+	if len(parts) != 3 || parts[0] != url.ID {
+		return false
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() >= expiresAt {
+		return false
+	}
+
+	expected := linkAccessSignature(secret, parts[0]+"|"+parts[1], url.AccessPasswordHash)
+	return hmac.Equal([]byte(parts[2]), []byte(expected))
+}
+
+func linkAccessSignature(secret []byte, payload, passwordHash string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	mac.Write([]byte(passwordHash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// failureLimiter counts failed attempts per key inside a fixed window and
+// blocks the key once it reaches the limit.
+type failureLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	failures map[string]*failureWindow
+}
+
+type failureWindow struct {
+	count   int
+	resetAt time.Time
+}
+
+func newFailureLimiter(limit int, window time.Duration) *failureLimiter {
+	return &failureLimiter{
+		limit:    limit,
+		window:   window,
+		failures: make(map[string]*failureWindow),
+	}
+}
+
+func (l *failureLimiter) Blocked(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.failures[key]
+	if !ok {
+		return false
+	}
+	if now.After(entry.resetAt) {
+		delete(l.failures, key)
+		return false
+	}
+	return entry.count >= l.limit
+}
+
+func (l *failureLimiter) Fail(key string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.failures[key]
+	if !ok || now.After(entry.resetAt) {
+		l.prune(now)
+		entry = &failureWindow{resetAt: now.Add(l.window)}
+		l.failures[key] = entry
+	}
+	entry.count++
+}
+
+func (l *failureLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+}
+
+func (l *failureLimiter) prune(now time.Time) {
+	for key, entry := range l.failures {
+		if now.After(entry.resetAt) {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// checkLinkPassword gates access to a password protected link. It reports
+// true when the request may proceed to the destination; otherwise it has
+// already written the password form or an error to w.
+func (h *shortUrlHandler) checkLinkPassword(w http.ResponseWriter, req *http.Request, url *Url) bool {
+	now := time.Now()
+
+	if cookie, err := req.Cookie(linkAccessCookieName(url)); err == nil {
+		if verifyLinkAccess(h.linkSecret, url, cookie.Value, now) {
+			return true
+		}
+	}
+
+	if req.Method != http.MethodPost {
+		renderPasswordForm(w, http.StatusOK, "")
+		return false
+	}
+
+	limiterKey := clientIP(req) + "|" + url.ID
+	if h.passwordFailures.Blocked(limiterKey, now) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(passwordFailureReset.Seconds())))
+		renderPasswordForm(w, http.StatusTooManyRequests, "Too many failed attempts, try again later")
+		return false
+	}
+
+	if err := VerifyPassword(url.AccessPasswordHash, req.PostFormValue("password")); err != nil {
+		h.passwordFailures.Fail(limiterKey, now)
+		renderPasswordForm(w, http.StatusUnauthorized, "Incorrect password")
+		return false
+	}
+	h.passwordFailures.Reset(limiterKey)
+
+	expiresAt := now.Add(linkAccessCookieTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     linkAccessCookieName(url),
+		Value:    signLinkAccess(h.linkSecret, url, expiresAt),
+		Path:     linkCookiePath(req),
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"net/url"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 2048
+)
+
+var qrRecoveryLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+type qrOptions struct {
+	format     string
+	size       int
+	level      qrcode.RecoveryLevel
+	foreground color.RGBA
+	background color.RGBA
+}
+
+// parseQROptions reads format (png or svg), size in pixels, level (L, M, Q
+// or H) and fg/bg as hex RGB colors from the query string.
+func parseQROptions(query url.Values) (*qrOptions, error) {
+	options := &qrOptions{
+		format:     "png",
+		size:       defaultQRSize,
+		level:      qrcode.Medium,
+		foreground: color.RGBA{0, 0, 0, 255},
+		background: color.RGBA{255, 255, 255, 255},
+	}
+
+	if format := strings.ToLower(query.Get("format")); format != "" {
+		if format != "png" && format != "svg" {
+			return nil, errors.New("format must be png or svg")
+		}
+		options.format = format
+	}
+
+	if value := query.Get("size"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			return nil, fmt.Errorf("size must be between %d and %d", minQRSize, maxQRSize)
+		}
+		options.size = size
+	}
+
+	if value := query.Get("level"); value != "" {
+		level, ok := qrRecoveryLevels[strings.ToUpper(value)]
+		if !ok {
+			return nil, errors.New("level must be one of L, M, Q, H")
+		}
+		options.level = level
+	}
+
+	var err error
+	if value := query.Get("fg"); value != "" {
+		if options.foreground, err = parseHexColor(value); err != nil {
+			return nil, fmt.Errorf("fg: %w", err)
+		}
+	}
+	if value := query.Get("bg"); value != "" {
+		if options.background, err = parseHexColor(value); err != nil {
+			return nil, fmt.Errorf("bg: %w", err)
+		}
+	}
+
+	return options, nil
+}
+
+func parseHexColor(value string) (color.RGBA, error) {
+	value = strings.TrimPrefix(value, "#")
+	if len(value) != 6 {
+		return color.RGBA{}, errors.New("color must be a 6 digit hex RGB value")
+	}
+
+	rgb, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return color.RGBA{}, errors.New("color must be a 6 digit hex RGB value")
+	}
+	return color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 255}, nil
+}
+
+// renderQRCode encodes content as a QR code and returns the image together
+// with its content type.
+func renderQRCode(content string, options *qrOptions) ([]byte, string, error) {
+	code, err := qrcode.New(content, options.level)
+	if err != nil {
+		return nil, "", err
+	}
+	code.ForegroundColor = options.foreground
+	code.BackgroundColor = options.background
+
+	if options.format == "svg" {
+		return renderQRCodeSVG(code, options), "image/svg+xml", nil
+	}
+
+	png, err := code.PNG(options.size)
+	if err != nil {
+		return nil, "", err
+	}
+	return png, "image/png", nil
+}
+
+// renderQRCodeSVG draws one rectangle per dark module on a grid of module
+// sized units, scaled to the requested size through the viewBox.
+func renderQRCodeSVG(code *qrcode.QRCode, options *qrOptions) []byte {
+	bitmap := code.Bitmap()
+	modules := len(bitmap)
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		options.size, options.size, modules, modules)
+	fmt.Fprintf(&svg, `<rect width="%d" height="%d" fill="%s"/>`, modules, modules, hexColor(options.background))
+	fmt.Fprintf(&svg, `<path fill="%s" d="`, hexColor(options.foreground))
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&svg, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	svg.WriteString(`"/></svg>`)
+
+	return []byte(svg.String())
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
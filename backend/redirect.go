@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidPassthroughPath = errors.New("passthrough path must not contain dot segments")
+
+var allowedRedirectStatuses = []int{
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+var allowedReferrerPolicies = []string{
+	"no-referrer",
+	"no-referrer-when-downgrade",
+	"origin",
+	"origin-when-cross-origin",
+	"same-origin",
+	"strict-origin",
+	"strict-origin-when-cross-origin",
+	"unsafe-url",
+}
+
+func validateRedirectProfile(status, cacheMaxAge int, referrerPolicy string) error {
+	if status != 0 && !slices.Contains(allowedRedirectStatuses, status) {
+		return errors.New("redirect_status must be one of 301, 302, 307, 308")
+	}
+	if cacheMaxAge < 0 {
+		return errors.New("cache_max_age must not be negative")
+	}
+	if referrerPolicy != "" && !slices.Contains(allowedReferrerPolicies, referrerPolicy) {
+		return errors.New("referrer_policy is not a valid Referrer-Policy value")
+	}
+	return nil
+}
+
+// redirectStatus is the status code the link redirects with, defaulting to
+// 307 for links that never chose one.
+func (u *Url) redirectStatus() int {
+	if u.RedirectStatus == 0 {
+		return http.StatusTemporaryRedirect
+	}
+	return u.RedirectStatus
+}
+
+// cacheable reports whether browsers and proxies may cache the redirect.
+// Links whose outcome depends on per-visit state, or that are scheduled to
+// change destination, never are.
+func (u *Url) cacheable() bool {
+	return u.CacheMaxAge > 0 && u.MaxClicks == 0 && u.AccessPasswordHash == "" && len(u.Variants) == 0 &&
+		len(u.ScheduledDestinations) == 0
+}
+
+// cacheMaxAge is how many seconds the redirect may be cached at now. It never
+// reaches past ExpiresAt, and zero means the redirect must not be cached.
+func (u *Url) cacheMaxAge(now time.Time) int {
+	if !u.cacheable() {
+		return 0
+	}
+	maxAge := u.CacheMaxAge
+	if u.ExpiresAt != nil {
+		maxAge = min(maxAge, int(u.ExpiresAt.Sub(now)/time.Second))
+	}
+	return max(maxAge, 0)
+}
+
+func writeRedirectHeaders(w http.ResponseWriter, link *Url, now time.Time) {
+	if maxAge := link.cacheMaxAge(now); maxAge > 0 {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	if len(link.TargetingRules) > 0 {
+		w.Header().Add("Vary", "User-Agent")
+	}
+	if link.ReferrerPolicy != "" {
+		w.Header().Set("Referrer-Policy", link.ReferrerPolicy)
+	}
+}
+
+// mergeQuery adds the parameters of query to destination. Parameters already
+// present in destination keep their values, and its query string is kept as
+// written; only the missing parameters are appended.
+func mergeQuery(destination string, query url.Values) (string, error) {
+	if len(query) == 0 {
+		return destination, nil
+	}
+
+	target, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+
+	existing := queryKeys(target.RawQuery)
+	missing := url.Values{}
+	for key, values := range query {
+		if !existing[key] {
+			missing[key] = values
+		}
+	}
+	if len(missing) == 0 {
+		return destination, nil
+	}
+
+	if target.RawQuery != "" && !strings.HasSuffix(target.RawQuery, "&") {
+		target.RawQuery += "&"
+	}
+	target.RawQuery += missing.Encode()
+
+	return target.String(), nil
+}
+
+// queryKeys returns the unescaped keys of a raw query string. Unlike
+// url.ParseQuery it keeps pairs containing semicolons and keys without a
+// value.
+func queryKeys(rawQuery string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		key, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		keys[key] = true
+	}
+	return keys
+}
+
+// splitShortPath splits the escaped request path into the escaped short code
+// segment and the escaped remainder, which is empty or starts with a slash.
+// A lone trailing slash counts as no remainder.
+func splitShortPath(req *http.Request) (code, rest string) {
+	path := strings.TrimPrefix(req.URL.EscapedPath(), "/")
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		if path[i:] == "/" {
+			return path[:i], ""
+		}
+		return path[:i], path[i:]
+	}
+	return path, ""
+}
+
+// validPassthroughPath reports whether the escaped path suffix rest is free
+// of "." and ".." segments, escaped or not, which browsers would resolve to
+// a path outside the destination's base path.
+func validPassthroughPath(rest string) bool {
+	unescaped, err := url.PathUnescape(rest)
+	if err != nil {
+		return false
+	}
+	for _, segment := range strings.Split(unescaped, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// linkCookiePath scopes cookies set for a link to its short code, including
+// any passthrough paths below it.
+func linkCookiePath(req *http.Request) string {
+	code, _ := splitShortPath(req)
+	return "/" + code
+}
+
+// finalDestination applies the link's passthrough, UTM tagging and query
+// forwarding settings for req to the chosen destination.
+func finalDestination(req *http.Request, link *Url, destination string) (string, error) {
+	if link.PathPassthrough {
+		_, rest := splitShortPath(req)
+		if rest != "" {
+			var err error
+			destination, err = appendPath(destination, rest)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// UTM parameters go first so the link's own tagging wins over anything
+	// the visitor passes along.
+	if !link.UTM.empty() {
+		var err error
+		destination, err = mergeQuery(destination, link.UTM.values())
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if link.ForwardQuery || link.PathPassthrough {
+		return mergeQuery(destination, req.URL.Query())
+	}
+	return destination, nil
+}
+
+// appendPath appends the escaped path suffix rest to the path of
+// destination, keeping the escaping of both parts intact.
+func appendPath(destination, rest string) (string, error) {
+	if !validPassthroughPath(rest) {
+		return "", ErrInvalidPassthroughPath
+	}
+
+	target, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+
+	unescapedRest, err := url.PathUnescape(rest)
+	if err != nil {
+		return "", err
+	}
+
+	escapedBase := strings.TrimSuffix(target.EscapedPath(), "/")
+	target.Path = strings.TrimSuffix(target.Path, "/") + unescapedRest
+	target.RawPath = escapedBase + rest
+
+	return target.String(), nil
+}
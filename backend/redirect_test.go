@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSplitShortPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		wantCode string
+		wantRest string
+	}{
+		{"/abc", "abc", ""},
+		{"/abc/", "abc", ""},
+		{"/abc/docs/intro", "abc", "/docs/intro"},
+		{"/abc/docs/", "abc", "/docs/"},
+		{"/abc/a%2Fb", "abc", "/a%2Fb"},
+		{"/abc/%2e%2e/admin", "abc", "/%2e%2e/admin"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		code, rest := splitShortPath(req)
+		if code != tt.wantCode || rest != tt.wantRest {
+			t.Errorf("splitShortPath(%q) = %q, %q; want %q, %q", tt.path, code, rest, tt.wantCode, tt.wantRest)
+		}
+	}
+}
+
+func TestValidPassthroughPath(t *testing.T) {
+	tests := []struct {
+		rest string
+		want bool
+	}{
+		{"/docs/intro", true},
+		{"/a%2Fb", true},
+		{"/..hidden/file.txt", true},
+		{"/..", false},
+		{"/./admin", false},
+		{"/docs/%2e%2e/%2e%2e/admin", false},
+		{"/docs/%2E/admin", false},
+		{"/a%2F..%2Fadmin", false},
+		{"/%zz", false},
+	}
+
+	for _, tt := range tests {
+		if got := validPassthroughPath(tt.rest); got != tt.want {
+			t.Errorf("validPassthroughPath(%q) = %v, want %v", tt.rest, got, tt.want)
+		}
+	}
+}
+
+func TestAppendPath(t *testing.T) {
+	tests := []struct {
+		destination string
+		rest        string
+		want        string
+		wantErr     error
+	}{
+		{"https://docs.example.com/guide", "/intro", "https://docs.example.com/guide/intro", nil},
+		{"https://docs.example.com/guide/", "/intro", "https://docs.example.com/guide/intro", nil},
+		{"https://docs.example.com", "/intro", "https://docs.example.com/intro", nil},
+		{"https://docs.example.com/guide?lang=en#top", "/intro", "https://docs.example.com/guide/intro?lang=en#top", nil},
+		{"https://docs.example.com/guide", "/a%2Fb", "https://docs.example.com/guide/a%2Fb", nil},
+		{"https://docs.example.com/a%2Fb", "/c", "https://docs.example.com/a%2Fb/c", nil},
+		{"https://docs.example.com/a%2Fb", "/c%20d", "https://docs.example.com/a%2Fb/c%20d", nil},
+		{"https://docs.example.com/guide", "/%2e%2e/%2e%2e/admin", "", ErrInvalidPassthroughPath},
+	}
+
+	for _, tt := range tests {
+		got, err := appendPath(tt.destination, tt.rest)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("appendPath(%q, %q) error = %v, want %v", tt.destination, tt.rest, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("appendPath(%q, %q) = %q, want %q", tt.destination, tt.rest, got, tt.want)
+		}
+	}
+}
+
+func TestFinalDestinationPassthrough(t *testing.T) {
+	tests := []struct {
+		name        string
+		link        Url
+		destination string
+		path        string
+		want        string
+	}{
+		{
+			name:        "path and query",
+			link:        Url{PathPassthrough: true},
+			destination: "https://docs.example.com/guide?lang=en",
+			path:        "/abc/intro?ref=mail",
+			want:        "https://docs.example.com/guide/intro?lang=en&ref=mail",
+		},
+		{
+			name:        "lone trailing slash",
+			link:        Url{PathPassthrough: true},
+			destination: "https://docs.example.com/guide",
+			path:        "/abc/",
+			want:        "https://docs.example.com/guide",
+		},
+		{
+			name:        "destination parameters win",
+			link:        Url{PathPassthrough: true},
+			destination: "https://docs.example.com/guide?lang=en",
+			path:        "/abc/intro?lang=de",
+			want:        "https://docs.example.com/guide/intro?lang=en",
+		},
+		{
+			name:        "utm before forwarded query",
+			link:        Url{ForwardQuery: true, UTM: UTMParams{Source: "news"}},
+			destination: "https://example.com/",
+			path:        "/abc?utm_source=spam&ref=x",
+			want:        "https://example.com/?utm_source=news&ref=x",
+		},
+		{
+			name:        "query not forwarded",
+			link:        Url{},
+			destination: "https://example.com/",
+			path:        "/abc?ref=x",
+			want:        "https://example.com/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			got, err := finalDestination(req, &tt.link, tt.destination)
+			if err != nil {
+				t.Fatalf("finalDestination failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("finalDestination = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+		query       url.Values
+		want        string
+	}{
+		{
+			name:        "no destination query",
+			destination: "https://example.com/page",
+			query:       url.Values{"utm_source": {"news"}, "utm_medium": {"email"}},
+			want:        "https://example.com/page?utm_medium=email&utm_source=news",
+		},
+		{
+			name:        "key without value",
+			destination: "https://example.com/page?flag&b=2",
+			query:       url.Values{"flag": {"on"}, "a": {"1"}},
+			want:        "https://example.com/page?flag&b=2&a=1",
+		},
+		{
+			name:        "semicolon inside pair",
+			destination: "https://example.com/page?a=1;b=2",
+			query:       url.Values{"a": {"x"}, "c": {"3"}},
+			want:        "https://example.com/page?a=1;b=2&c=3",
+		},
+		{
+			name:        "existing utm keys kept",
+			destination: "https://example.com/page?utm_source=partner&utm_campaign=spring",
+			query:       url.Values{"utm_source": {"news"}, "utm_campaign": {"summer"}, "utm_medium": {"email"}},
+			want:        "https://example.com/page?utm_source=partner&utm_campaign=spring&utm_medium=email",
+		},
+		{
+			name:        "percent-encoded keys",
+			destination: "https://example.com/page?utm%5Fsource=partner&a%20b=1",
+			query:       url.Values{"utm_source": {"news"}, "a b": {"2"}, "c d": {"3"}},
+			want:        "https://example.com/page?utm%5Fsource=partner&a%20b=1&c+d=3",
+		},
+		{
+			name:        "unsorted keys and fragment kept",
+			destination: "https://example.com/page?z=1&a=2#section",
+			query:       url.Values{"m": {"3"}},
+			want:        "https://example.com/page?z=1&a=2&m=3#section",
+		},
+		{
+			name:        "trailing ampersand",
+			destination: "https://example.com/page?a=1&",
+			query:       url.Values{"b": {"2"}},
+			want:        "https://example.com/page?a=1&b=2",
+		},
+		{
+			name:        "nothing missing",
+			destination: "https://example.com/page?b=1;a=2&utm_source=x",
+			query:       url.Values{"utm_source": {"news"}},
+			want:        "https://example.com/page?b=1;a=2&utm_source=x",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeQuery(tt.destination, tt.query)
+			if err != nil {
+				t.Fatalf("mergeQuery failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("mergeQuery = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReputationCacheTTL        = time.Hour
+	defaultReputationRecheckInterval = 24 * time.Hour
+	defaultReputationQueue           = 1000
+	reputationRecheckBatchSize       = 500
+	reputationCheckTimeout           = 10 * time.Second
+)
+
+type reputationVerdict string
+
+const (
+	verdictSafe       reputationVerdict = "safe"
+	verdictSuspicious reputationVerdict = "suspicious"
+	verdictMalicious  reputationVerdict = "malicious"
+)
+
+// severity orders verdicts so the worst of several can be picked.
+func (v reputationVerdict) severity() int {
+	switch v {
+	case verdictSuspicious:
+		return 1
+	case verdictMalicious:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// urlReputationChecker classifies a destination.
+type urlReputationChecker interface {
+	Check(ctx context.Context, destination string) (reputationVerdict, error)
+}
+
+// httpReputationChecker asks a reputation service over HTTP. The service is
+// queried with GET <endpoint>?url=<destination> and answers with a JSON
+// object of the form {"verdict": "safe"}.
+type httpReputationChecker struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newHTTPReputationChecker(endpoint string) *httpReputationChecker {
+	return &httpReputationChecker{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: reputationCheckTimeout},
+	}
+}
+
+func (c *httpReputationChecker) Check(ctx context.Context, destination string) (reputationVerdict, error) {
+	endpoint, err := url.Parse(c.endpoint)
+	if err != nil {
+		return "", err
+	}
+	query := endpoint.Query()
+	query.Set("url", destination)
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("reputation service answered %s", resp.Status)
+	}
+
+	var body struct {
+		Verdict reputationVerdict `json:"verdict"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	switch body.Verdict {
+	case verdictSafe, verdictSuspicious, verdictMalicious:
+		return body.Verdict, nil
+	}
+	return "", fmt.Errorf("unknown reputation verdict %q", body.Verdict)
+}
+
+type reputationCacheEntry struct {
+	verdict   reputationVerdict
+	expiresAt time.Time
+}
+
+// cachedReputationChecker remembers verdicts of the wrapped checker for ttl.
+// Failed checks are not cached.
+type cachedReputationChecker struct {
+	urlReputationChecker
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]reputationCacheEntry
+}
+
+func newCachedReputationChecker(inner urlReputationChecker, ttl time.Duration) *cachedReputationChecker {
+	return &cachedReputationChecker{
+		urlReputationChecker: inner,
+		ttl:                  ttl,
+		entries:              make(map[string]reputationCacheEntry),
+	}
+}
+
+func (c *cachedReputationChecker) Check(ctx context.Context, destination string) (reputationVerdict, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[destination]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.verdict, nil
+	}
+
+	verdict, err := c.urlReputationChecker.Check(ctx, destination)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, cached := range c.entries {
+		if !now.Before(cached.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[destination] = reputationCacheEntry{verdict: verdict, expiresAt: now.Add(c.ttl)}
+	return verdict, nil
+}
+
+// ownerNotifier tells the owner of a link that it was disabled.
+type ownerNotifier interface {
+	NotifyLinkDisabled(owner *User, link *Url, verdict reputationVerdict) error
+}
+
+// logOwnerNotifier only logs the notification; it is used when no webhook is
+// configured.
+type logOwnerNotifier struct{}
+
+func (logOwnerNotifier) NotifyLinkDisabled(owner *User, link *Url, verdict reputationVerdict) error {
+	log.Println("Disabled URL", link.ID, "of user", owner.ID, "after a", verdict, "reputation verdict")
+	return nil
+}
+
+// webhookOwnerNotifier posts notifications as JSON to a webhook, which is
+// expected to deliver them to the owner's email address.
+type webhookOwnerNotifier struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (n *webhookOwnerNotifier) NotifyLinkDisabled(owner *User, link *Url, verdict reputationVerdict) error {
+	payload, err := json.Marshal(map[string]any{
+		"event":     "link_disabled",
+		"user_id":   owner.ID,
+		"email":     owner.Email,
+		"link_id":   link.ID,
+		"domain":    link.Domain,
+		"short_url": link.ShortUrl,
+		"long_url":  link.LongUrl,
+		"verdict":   verdict,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// reputationMonitor checks the destinations of new and changed links off the
+// request path, and of every link again each recheckInterval, and disables
+// links that are not safe. Like clickRecorder it drops submitted work when
+// its queue is full instead of slowing down the API.
+type reputationMonitor struct {
+	checker         urlReputationChecker
+	urls            urlStore
+	users           userStore
+	notifier        ownerNotifier
+	lock            exclusiveRunner
+	recheckInterval time.Duration
+	queue           chan string
+	stop            chan struct{}
+	wg              sync.WaitGroup
+	rechecks        sync.WaitGroup
+	closeOnce       sync.Once
+}
+
+// reputationMonitorFromEnv returns nil unless REPUTATION_CHECK_URL names a
+// reputation service. Verdicts are cached for REPUTATION_CACHE_TTL, a
+// duration defaulting to an hour, every link is checked again each
+// REPUTATION_RECHECK_INTERVAL, defaulting to a day, and owners are notified
+// through OWNER_NOTIFY_WEBHOOK_URL when it is set.
+func reputationMonitorFromEnv(urls urlStore, users userStore, lock exclusiveRunner) *reputationMonitor {
+	endpoint := os.Getenv("REPUTATION_CHECK_URL")
+	if endpoint == "" {
+		return nil
+	}
+
+	ttl := defaultReputationCacheTTL
+	if value := os.Getenv("REPUTATION_CACHE_TTL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			ttl = parsed
+		} else {
+			log.Println("Ignoring invalid REPUTATION_CACHE_TTL:", value)
+		}
+	}
+
+	recheckInterval := defaultReputationRecheckInterval
+	if value := os.Getenv("REPUTATION_RECHECK_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			recheckInterval = parsed
+		} else {
+			log.Println("Ignoring invalid REPUTATION_RECHECK_INTERVAL:", value)
+		}
+	}
+
+	var notifier ownerNotifier = logOwnerNotifier{}
+	if webhook := os.Getenv("OWNER_NOTIFY_WEBHOOK_URL"); webhook != "" {
+		notifier = &webhookOwnerNotifier{
+			endpoint: webhook,
+			client:   &http.Client{Timeout: reputationCheckTimeout},
+		}
+	}
+
+	return newReputationMonitor(newCachedReputationChecker(newHTTPReputationChecker(endpoint), ttl),
+		urls, users, notifier, lock, recheckInterval)
+}
+
+func newReputationMonitor(checker urlReputationChecker, urls urlStore, users userStore, notifier ownerNotifier, lock exclusiveRunner, recheckInterval time.Duration) *reputationMonitor {
+	return &reputationMonitor{
+		checker:         checker,
+		urls:            urls,
+		users:           users,
+		notifier:        notifier,
+		lock:            lock,
+		recheckInterval: recheckInterval,
+		queue:           make(chan string, defaultReputationQueue),
+		stop:            make(chan struct{}),
+	}
+}
+
+func (m *reputationMonitor) Start() {
+	if m == nil {
+		return
+	}
+	m.wg.Add(1)
+	go m.run()
+	m.rechecks.Add(1)
+	go m.recheckPeriodically()
+}
+
+// Close stops the periodic re-checks and accepting links, and waits until
+// the queued ones are checked.
+func (m *reputationMonitor) Close() {
+	if m == nil {
+		return
+	}
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		m.rechecks.Wait()
+		close(m.queue)
+	})
+	m.wg.Wait()
+}
+
+// Submit queues link for a reputation check. It does nothing when no
+// reputation service is configured.
+func (m *reputationMonitor) Submit(link *Url) {
+	if m == nil {
+		return
+	}
+
+	select {
+	case m.queue <- link.ID:
+	default:
+		log.Println("Reputation queue full, skipping check of URL", link.ID)
+	}
+}
+
+// recheckPeriodically queues every link for another check each
+// recheckInterval, so destinations that turn bad after a link was created
+// are caught too. Only one instance re-checks at a time.
+func (m *reputationMonitor) recheckPeriodically() {
+	defer m.rechecks.Done()
+
+	ticker := time.NewTicker(m.recheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			if _, err := m.lock.TryRun(reputationRecheckLockKey, m.recheckAll); err != nil {
+				log.Println("Error locking reputation re-check:", err)
+			}
+		}
+	}
+}
+
+// recheckAll queues the links batch by batch in ID order. Unlike Submit it
+// waits for room in the queue rather than skipping links.
+func (m *reputationMonitor) recheckAll() {
+	cursor := ""
+	for {
+		links, err := m.urls.ListForReputationCheck(cursor, reputationRecheckBatchSize)
+		if err != nil {
+			log.Println("Error listing URLs for reputation checks:", err)
+			return
+		}
+
+		for _, link := range links {
+			select {
+			case m.queue <- link.ID:
+			case <-m.stop:
+				return
+			}
+		}
+
+		if len(links) < reputationRecheckBatchSize {
+			return
+		}
+		cursor = links[len(links)-1].ID
+	}
+}
+
+func (m *reputationMonitor) run() {
+	defer m.wg.Done()
+
+	for urlId := range m.queue {
+		if err := m.check(urlId); err != nil {
+			log.Println("Error checking reputation of URL", urlId, ":", err)
+		}
+	}
+}
+
+// check loads the current version of the link, so edits made while it was
+// queued are taken into account, and disables it unless every destination
+// is safe. A disabled link whose destinations are all safe again, for
+// example after its owner changed them, is enabled again.
+func (m *reputationMonitor) check(urlId string) error {
+	link, err := m.urls.GetByID(urlId)
+	if err != nil {
+		return err
+	}
+
+	verdict, err := m.worstVerdict(&link)
+	if err != nil {
+		return err
+	}
+	if verdict == verdictSafe {
+		if link.DisabledAt == nil {
+			return nil
+		}
+		if err := m.urls.SetDisabled(link.ID, nil, ""); err != nil {
+			return err
+		}
+		log.Println("Enabled URL", link.ID, "after a safe reputation verdict")
+		return nil
+	}
+	if link.DisabledAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	link.DisabledAt = &now
+	link.DisabledReason = string(verdict)
+	if err := m.urls.SetDisabled(link.ID, link.DisabledAt, link.DisabledReason); err != nil {
+		return err
+	}
+	log.Println("Disabled URL", link.ID, "after a", verdict, "reputation verdict")
+
+	owner, err := m.users.GetById(link.UserId)
+	if err != nil {
+		return err
+	}
+	return m.notifier.NotifyLinkDisabled(&owner, &link, verdict)
+}
+
+func (m *reputationMonitor) worstVerdict(link *Url) (reputationVerdict, error) {
+	destinations := []string{link.LongUrl}
+	if link.FallbackUrl != "" {
+		destinations = append(destinations, link.FallbackUrl)
+	}
+	for _, rule := range link.TargetingRules {
+		destinations = append(destinations, rule.Destination)
+	}
+	for _, variant := range link.Variants {
+		destinations = append(destinations, variant.Destination)
+	}
+	for _, change := range link.ScheduledDestinations {
+		destinations = append(destinations, change.Destination)
+	}
+
+	worst := verdictSafe
+	for _, destination := range destinations {
+		ctx, cancel := context.WithTimeout(context.Background(), reputationCheckTimeout)
+		verdict, err := m.checker.Check(ctx, destination)
+		cancel()
+		if err != nil {
+			return "", err
+		}
+		if verdict.severity() > worst.severity() {
+			worst = verdict
+		}
+	}
+	return worst, nil
+}
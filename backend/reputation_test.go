@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// reputationStandIn is a local stand-in for a reputation service speaking
+// the protocol of httpReputationChecker. It answers with the verdict listed
+// for the destination's hostname and safe for everything else, which makes
+// it usable behind httptest.NewServer.
+type reputationStandIn struct {
+	verdicts map[string]reputationVerdict
+}
+
+func (s *reputationStandIn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	target, err := url.Parse(req.URL.Query().Get("url"))
+	if err != nil || target.Host == "" {
+		http.Error(w, "Invalid url", http.StatusBadRequest)
+		return
+	}
+
+	verdict, ok := s.verdicts[normalizeHostname(target.Hostname())]
+	if !ok {
+		verdict = verdictSafe
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]reputationVerdict{"verdict": verdict})
+}
+
+func newReputationStandInServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(&reputationStandIn{verdicts: map[string]reputationVerdict{
+		"evil.example": verdictMalicious,
+		"odd.example":  verdictSuspicious,
+	}})
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPReputationChecker(t *testing.T) {
+	checker := newHTTPReputationChecker(newReputationStandInServer(t).URL)
+
+	tests := []struct {
+		destination string
+		want        reputationVerdict
+	}{
+		{"https://example.com/page", verdictSafe},
+		{"https://evil.example/login?next=/", verdictMalicious},
+		{"http://ODD.example:8080/", verdictSuspicious},
+	}
+
+	for _, tt := range tests {
+		got, err := checker.Check(context.Background(), tt.destination)
+		if err != nil {
+			t.Fatalf("Check(%q) failed: %v", tt.destination, err)
+		}
+		if got != tt.want {
+			t.Errorf("Check(%q) = %q, want %q", tt.destination, got, tt.want)
+		}
+	}
+}
+
+// fakeUrlStore keeps links in memory. Methods the reputation monitor does not
+// use are left to the embedded nil interface.
+type fakeUrlStore struct {
+	urlStore
+	urls map[string]Url
+}
+
+func (s *fakeUrlStore) GetByID(urlId string) (Url, error) {
+	link, ok := s.urls[urlId]
+	if !ok {
+		return Url{}, gorm.ErrRecordNotFound
+	}
+	return link, nil
+}
+
+func (s *fakeUrlStore) SetDisabled(urlId string, disabledAt *time.Time, reason string) error {
+	link := s.urls[urlId]
+	link.DisabledAt = disabledAt
+	link.DisabledReason = reason
+	s.urls[urlId] = link
+	return nil
+}
+
+type fakeUserStore struct {
+	userStore
+}
+
+func (fakeUserStore) GetById(userId string) (User, error) {
+	return User{ID: userId, Email: "owner@example.com"}, nil
+}
+
+type recordingNotifier struct {
+	verdicts []reputationVerdict
+}
+
+func (n *recordingNotifier) NotifyLinkDisabled(owner *User, link *Url, verdict reputationVerdict) error {
+	n.verdicts = append(n.verdicts, verdict)
+	return nil
+}
+
+func TestReputationMonitorCheck(t *testing.T) {
+	urls := &fakeUrlStore{urls: map[string]Url{
+		"link": {ID: "link", UserId: "owner", LongUrl: "https://example.com/", Variants: []Variant{
+			{Name: "a", Destination: "https://example.com/a", Weight: 1},
+			{Name: "b", Destination: "https://evil.example/b", Weight: 1},
+		}},
+	}}
+	notifier := &recordingNotifier{}
+	checker := newHTTPReputationChecker(newReputationStandInServer(t).URL)
+	monitor := newReputationMonitor(checker, urls, fakeUserStore{}, notifier, nil, time.Hour)
+
+	if err := monitor.check("link"); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	link := urls.urls["link"]
+	if link.DisabledAt == nil || link.DisabledReason != string(verdictMalicious) {
+		t.Fatalf("link with a malicious variant not disabled: at %v, reason %q", link.DisabledAt, link.DisabledReason)
+	}
+	if len(notifier.verdicts) != 1 || notifier.verdicts[0] != verdictMalicious {
+		t.Fatalf("owner notifications = %v, want one malicious", notifier.verdicts)
+	}
+
+	// Checking a link that is still bad must not notify the owner again.
+	if err := monitor.check("link"); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	if len(notifier.verdicts) != 1 {
+		t.Errorf("owner notified %d times, want once", len(notifier.verdicts))
+	}
+
+	link.Variants[1].Destination = "https://example.com/b"
+	urls.urls["link"] = link
+	if err := monitor.check("link"); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	if link := urls.urls["link"]; link.DisabledAt != nil || link.DisabledReason != "" {
+		t.Errorf("link with safe destinations still disabled: at %v, reason %q", link.DisabledAt, link.DisabledReason)
+	}
+}
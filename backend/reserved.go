@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrShortCodeReserved  = errors.New("short URL is reserved")
+	ErrShortCodeOffensive = errors.New("short URL contains offensive language")
+	ErrAdminRequired      = errors.New("only admins can override the short URL policy")
+)
+
+// defaultReservedShortCodes collide with routes registered in main or are
+// kept free for routes the service may add later.
+var defaultReservedShortCodes = []string{
+	"api", "admin", "auth", "login", "logout", "register", "signup",
+	"health", "healthz", "status", "metrics", "debug", "static", "assets",
+	"app", "dashboard", "docs", "help", "www", "favicon.ico", "robots.txt",
+	".well-known",
+}
+
+// defaultOffensiveWords is deliberately short so it does not reject
+// innocent codes that happen to contain a blocked word; deployments extend
+// it through OFFENSIVE_WORDS.
+var defaultOffensiveWords = []string{
+	"fuck", "shit", "cunt", "bitch", "whore", "slut", "nigger", "nigga",
+	"faggot", "retard", "nazi", "porn",
+}
+
+// leetReplacer undoes common character substitutions before codes are
+// compared against the offensive word list.
+var leetReplacer = strings.NewReplacer(
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s",
+	"-", "", "_", "", ".", "",
+)
+
+// shortCodePolicy rejects short codes that are reserved for the service or
+// contain offensive words.
+type shortCodePolicy struct {
+	reserved  []string
+	offensive []string
+}
+
+// shortCodePolicyFromEnv extends the built-in lists with the comma separated
+// RESERVED_SHORT_CODES and OFFENSIVE_WORDS.
+func shortCodePolicyFromEnv() *shortCodePolicy {
+	return &shortCodePolicy{
+		reserved:  append(slices.Clone(defaultReservedShortCodes), splitWordList(os.Getenv("RESERVED_SHORT_CODES"))...),
+		offensive: append(slices.Clone(defaultOffensiveWords), splitWordList(os.Getenv("OFFENSIVE_WORDS"))...),
+	}
+}
+
+func splitWordList(value string) []string {
+	var words []string
+	for _, word := range strings.Split(value, ",") {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// Check reports whether code may be used as a short code. Reserved codes
+// match case-insensitively; offensive words match anywhere in the code.
+func (p *shortCodePolicy) Check(code string) error {
+	lower := strings.ToLower(code)
+	if slices.Contains(p.reserved, lower) {
+		return ErrShortCodeReserved
+	}
+
+	normalized := leetReplacer.Replace(lower)
+	for _, word := range p.offensive {
+		if strings.Contains(normalized, word) {
+			return ErrShortCodeOffensive
+		}
+	}
+	return nil
+}
+
+// checkShortCode enforces the short code policy unless the request asks to
+// override it, which only admins may do.
+func (h *apiHandler) checkShortCode(code string, override bool, userId string) error {
+	if override {
+		user, err := h.userDb.GetById(userId)
+		if err != nil {
+			return err
+		}
+		if !user.IsAdmin {
+			return ErrAdminRequired
+		}
+		return nil
+	}
+	return h.shortCodes.Check(code)
+}
+
+func writeShortCodeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrShortCodeReserved), errors.Is(err, ErrShortCodeOffensive):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrAdminRequired):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, "Error checking short URL", http.StatusInternalServerError)
+		log.Println("Error checking short URL :", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+var notYetAvailableTemplate = template.Must(template.New("not-yet-available").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Not yet available</title>
+</head>
+<body>
+	<h1>This link is not yet available</h1>
+	<p>Please come back after {{.StartsAt}}.</p>
+</body>
+</html>
+`))
+
+// validateSchedule checks the activation time and the scheduled destination
+// changes of a link and sorts the changes by time.
+func validateSchedule(startsAt, expiresAt *time.Time, changes []ScheduledDestination) error {
+	if startsAt != nil && expiresAt != nil && !startsAt.Before(*expiresAt) {
+		return errors.New("starts_at must be before expires_at")
+	}
+
+	slices.SortFunc(changes, func(a, b ScheduledDestination) int {
+		return a.At.Compare(b.At)
+	})
+	for i, change := range changes {
+		if change.At.IsZero() {
+			return fmt.Errorf("scheduled_destinations[%d].at is required", i)
+		}
+		if change.Destination == "" {
+			return fmt.Errorf("scheduled_destinations[%d].destination is required", i)
+		}
+		if i > 0 && change.At.Equal(changes[i-1].At) {
+			return fmt.Errorf("scheduled_destinations[%d].at is used by another change", i)
+		}
+	}
+	return nil
+}
+
+// NotStarted reports whether the link is still waiting for its StartsAt.
+func (u *Url) NotStarted(now time.Time) bool {
+	return u.StartsAt != nil && now.Before(*u.StartsAt)
+}
+
+// currentLongUrl returns the destination in effect at now: the latest
+// scheduled change that is due, or LongUrl when none is. Changes are kept
+// sorted by time.
+func (u *Url) currentLongUrl(now time.Time) string {
+	destination := u.LongUrl
+	for _, change := range u.ScheduledDestinations {
+		if change.At.After(now) {
+			break
+		}
+		destination = change.Destination
+	}
+	return destination
+}
+
+// applyDueDestinations moves the latest due scheduled change into LongUrl
+// and drops every due change. It reports whether anything changed.
+func (u *Url) applyDueDestinations(now time.Time) bool {
+	due := 0
+	for due < len(u.ScheduledDestinations) && !u.ScheduledDestinations[due].At.After(now) {
+		due++
+	}
+	if due == 0 {
+		return false
+	}
+
+	u.LongUrl = u.ScheduledDestinations[due-1].Destination
+	u.ScheduledDestinations = slices.Clone(u.ScheduledDestinations[due:])
+	return true
+}
+
+func renderNotYetAvailable(w http.ResponseWriter, startsAt time.Time) {
+	retryAfter := max(int(time.Until(startsAt).Seconds()), 1)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	notYetAvailableTemplate.Execute(w, struct{ StartsAt string }{startsAt.UTC().Format(time.RFC1123)})
+}
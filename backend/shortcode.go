@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultShortCodeAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	defaultShortCodeLength   = 7
+	maxShortCodeAttempts     = 5
+)
+
+var ErrShortCodeExhausted = errors.New("could not generate a unique short code")
+
+// unreservedURLChars are the characters RFC 3986 allows in a path segment
+// without escaping.
+const unreservedURLChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-._~"
+
+type shortCodeGenerator struct {
+	alphabet string
+	length   int
+}
+
+func newShortCodeGenerator(alphabet string, length int) *shortCodeGenerator {
+	if alphabet == "" {
+		alphabet = defaultShortCodeAlphabet
+	}
+	if length <= 0 {
+		length = defaultShortCodeLength
+	}
+	return &shortCodeGenerator{alphabet: alphabet, length: length}
+}
+
+// shortCodeGeneratorFromEnv reads SHORT_CODE_ALPHABET and SHORT_CODE_LENGTH,
+// falling back to base62 codes of defaultShortCodeLength characters.
+func shortCodeGeneratorFromEnv() (*shortCodeGenerator, error) {
+	length, err := strconv.Atoi(os.Getenv("SHORT_CODE_LENGTH"))
+	if err != nil {
+		length = defaultShortCodeLength
+	}
+	alphabet := os.Getenv("SHORT_CODE_ALPHABET")
+	if alphabet != "" {
+		if err := validateShortCodeAlphabet(alphabet); err != nil {
+			return nil, err
+		}
+	}
+	return newShortCodeGenerator(alphabet, length), nil
+}
+
+// validateShortCodeAlphabet requires at least two distinct characters, all
+// unreserved in URLs so generated codes are routable without escaping.
+// Repeated characters would skew the distribution of codes.
+func validateShortCodeAlphabet(alphabet string) error {
+	seen := make(map[rune]bool, len(alphabet))
+	for _, char := range alphabet {
+		if !strings.ContainsRune(unreservedURLChars, char) {
+			return fmt.Errorf("SHORT_CODE_ALPHABET contains %q, which is not an unreserved URL character", char)
+		}
+		if seen[char] {
+			return fmt.Errorf("SHORT_CODE_ALPHABET contains %q more than once", char)
+		}
+		seen[char] = true
+	}
+	if len(seen) < 2 {
+		return errors.New("SHORT_CODE_ALPHABET must contain at least 2 characters")
+	}
+	return nil
+}
+
+func (g *shortCodeGenerator) Generate() (string, error) {
+	size := big.NewInt(int64(len(g.alphabet)))
+	code := make([]byte, g.length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
+		}
+		code[i] = g.alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
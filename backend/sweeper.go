@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const defaultSweepInterval = time.Minute
+
+// runExpirySweeper periodically archives links whose ExpiresAt has passed and
+// stores scheduled destination changes that became due until ctx is
+// cancelled. Redirects follow the schedule on their own; storing the changes
+// keeps LongUrl current for the API.
+func runExpirySweeper(ctx context.Context, store urlStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			archived, err := store.ArchiveExpired(now)
+			if err != nil {
+				log.Println("Error archiving expired URLs:", err)
+				continue
+			}
+			if archived > 0 {
+				log.Println("Archived", archived, "expired URLs")
+			}
+			applyScheduledDestinations(store, now)
+		}
+	}
+}
+
+// applyScheduledDestinations stores due changes of links that were not
+// edited since they were listed; edited ones are picked up on the next
+// sweep.
+func applyScheduledDestinations(store urlStore, now time.Time) {
+	urls, err := store.ListScheduled()
+	if err != nil {
+		log.Println("Error listing scheduled URLs:", err)
+		return
+	}
+
+	for _, url := range urls {
+		if !url.applyDueDestinations(now) {
+			continue
+		}
+		applied, err := store.ApplyScheduledDestination(url.ID, url.LongUrl, url.ScheduledDestinations, url.UpdatedAt)
+		if err != nil {
+			log.Println("Error applying scheduled destination of URL", url.ID, ":", err)
+			continue
+		}
+		if applied {
+			log.Println("Switched URL", url.ID, "to its scheduled destination")
+		}
+	}
+}
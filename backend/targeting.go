@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+const maxTargetingRules = 20
+
+func validateTargetingRules(rules []TargetingRule) error {
+	if len(rules) > maxTargetingRules {
+		return fmt.Errorf("at most %d targeting_rules are allowed", maxTargetingRules)
+	}
+	for i, rule := range rules {
+		if rule.OS == "" && rule.Device == "" {
+			return fmt.Errorf("targeting_rules[%d] must set os or device", i)
+		}
+		if rule.OS != "" && !slices.Contains(knownOSes, rule.OS) {
+			return fmt.Errorf("targeting_rules[%d].os must be one of %v", i, knownOSes)
+		}
+		if rule.Device != "" && !slices.Contains(knownDevices, rule.Device) {
+			return fmt.Errorf("targeting_rules[%d].device must be one of %v", i, knownDevices)
+		}
+		if rule.Destination == "" {
+			return errors.New("targeting_rules destination must not be empty")
+		}
+	}
+	return nil
+}
+
+func (r *TargetingRule) matches(info userAgentInfo) bool {
+	return (r.OS == "" || r.OS == info.OS) && (r.Device == "" || r.Device == info.Device)
+}
+
+// targetedDestination returns the destination of the first targeting rule
+// matching the visitor making req.
+func (u *Url) targetedDestination(req *http.Request) (string, bool) {
+	if len(u.TargetingRules) == 0 {
+		return "", false
+	}
+
+	info := parseUserAgent(req.UserAgent())
+	for _, rule := range u.TargetingRules {
+		if rule.matches(info) {
+			return rule.Destination, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,65 @@
+package main
+
+import "strings"
+
+const (
+	osIOS     = "ios"
+	osAndroid = "android"
+	osWindows = "windows"
+	osMacOS   = "macos"
+	osLinux   = "linux"
+	osOther   = "other"
+
+	deviceMobile  = "mobile"
+	deviceTablet  = "tablet"
+	deviceDesktop = "desktop"
+	deviceBot     = "bot"
+	deviceUnknown = "unknown"
+)
+
+var (
+	knownOSes    = []string{osIOS, osAndroid, osWindows, osMacOS, osLinux, osOther}
+	knownDevices = []string{deviceMobile, deviceTablet, deviceDesktop, deviceBot, deviceUnknown}
+)
+
+type userAgentInfo struct {
+	OS     string
+	Device string
+}
+
+// parseUserAgent classifies a User-Agent header by operating system and
+// device form factor. It only looks for well-known tokens, which is enough
+// for analytics and targeting but not for feature detection.
+func parseUserAgent(userAgent string) userAgentInfo {
+	ua := strings.ToLower(userAgent)
+	info := userAgentInfo{OS: osOther, Device: deviceDesktop}
+
+	switch {
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad") || strings.Contains(ua, "ipod"):
+		info.OS = osIOS
+	case strings.Contains(ua, "android"):
+		info.OS = osAndroid
+	case strings.Contains(ua, "windows"):
+		info.OS = osWindows
+	case strings.Contains(ua, "mac os") || strings.Contains(ua, "macintosh"):
+		info.OS = osMacOS
+	case strings.Contains(ua, "linux") || strings.Contains(ua, "x11"):
+		info.OS = osLinux
+	}
+
+	switch {
+	case ua == "":
+		info.Device = deviceUnknown
+	case strings.Contains(ua, "bot") || strings.Contains(ua, "spider") || strings.Contains(ua, "crawl"):
+		info.Device = deviceBot
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet"):
+		info.Device = deviceTablet
+	case info.OS == osAndroid && !strings.Contains(ua, "mobi"):
+		// Android tablets omit the "Mobile" token.
+		info.Device = deviceTablet
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") || strings.Contains(ua, "ipod"):
+		info.Device = deviceMobile
+	}
+
+	return info
+}
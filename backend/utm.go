@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+const maxUTMValueLength = 200
+
+// UTMParams are campaign tracking parameters merged into a link's
+// destination at redirect time.
+type UTMParams struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+func (p UTMParams) empty() bool {
+	return p == UTMParams{}
+}
+
+// buildUTMParams trims and validates the UTM fields of a request. utm_source
+// is required as soon as any other field is set, as analytics tools drop
+// campaigns without one.
+func buildUTMParams(p UTMParams) (UTMParams, error) {
+	built := UTMParams{
+		Source:   strings.TrimSpace(p.Source),
+		Medium:   strings.TrimSpace(p.Medium),
+		Campaign: strings.TrimSpace(p.Campaign),
+		Term:     strings.TrimSpace(p.Term),
+		Content:  strings.TrimSpace(p.Content),
+	}
+	if built.empty() {
+		return built, nil
+	}
+
+	if built.Source == "" {
+		return UTMParams{}, errors.New("utm.source is required when other utm fields are set")
+	}
+
+	fields := []struct{ name, value string }{
+		{"source", built.Source},
+		{"medium", built.Medium},
+		{"campaign", built.Campaign},
+		{"term", built.Term},
+		{"content", built.Content},
+	}
+	for _, field := range fields {
+		if len(field.value) > maxUTMValueLength {
+			return UTMParams{}, fmt.Errorf("utm.%s must be at most %d characters long", field.name, maxUTMValueLength)
+		}
+		if strings.IndexFunc(field.value, unicode.IsControl) >= 0 {
+			return UTMParams{}, fmt.Errorf("utm.%s must not contain control characters", field.name)
+		}
+	}
+
+	return built, nil
+}
+
+func (p UTMParams) values() url.Values {
+	values := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	set("utm_source", p.Source)
+	set("utm_medium", p.Medium)
+	set("utm_campaign", p.Campaign)
+	set("utm_term", p.Term)
+	set("utm_content", p.Content)
+	return values
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+const (
+	maxVariants         = 10
+	maxVariantWeight    = 1_000_000
+	variantCookieTTL    = 90 * 24 * time.Hour
+	variantCookiePrefix = "link_variant_"
+)
+
+func validateVariants(variants []Variant) error {
+	if len(variants) == 0 {
+		return nil
+	}
+	if len(variants) < 2 || len(variants) > maxVariants {
+		return fmt.Errorf("variants must contain between 2 and %d entries", maxVariants)
+	}
+
+	names := make(map[string]bool, len(variants))
+	for i, variant := range variants {
+		// Names are stored in a cookie, which must not alter them.
+		if !variantNameRegEx.MatchString(variant.Name) {
+			return fmt.Errorf("variants[%d].name must be 1 to 64 letters, digits, '.', '_' or '-'", i)
+		}
+		if names[variant.Name] {
+			return fmt.Errorf("variants[%d].name %q is used more than once", i, variant.Name)
+		}
+		names[variant.Name] = true
+
+		if variant.Weight <= 0 || variant.Weight > maxVariantWeight {
+			return fmt.Errorf("variants[%d].weight must be between 1 and %d", i, maxVariantWeight)
+		}
+		if variant.Destination == "" {
+			return fmt.Errorf("variants[%d].destination must not be empty", i)
+		}
+	}
+	return nil
+}
+
+// chooseDestination picks where the visitor making req is sent: a matching
+// targeting rule first, then the visitor's A/B variant, then LongUrl. The
+// returned variant name is empty unless a variant was used.
+func chooseDestination(w http.ResponseWriter, req *http.Request, link *Url) (destination, variant string) {
+	if destination, ok := link.targetedDestination(req); ok {
+		return destination, ""
+	}
+	if len(link.Variants) == 0 {
+		return link.LongUrl, ""
+	}
+
+	chosen := assignVariant(w, req, link)
+	return chosen.Destination, chosen.Name
+}
+
+// assignVariant returns the variant the visitor was assigned before, as
+// remembered by a cookie, or draws a new one weighted by Variant.Weight.
+func assignVariant(w http.ResponseWriter, req *http.Request, link *Url) *Variant {
+	cookieName := variantCookiePrefix + link.ID
+	if cookie, err := req.Cookie(cookieName); err == nil {
+		for i := range link.Variants {
+			if link.Variants[i].Name == cookie.Value {
+				return &link.Variants[i]
+			}
+		}
+	}
+
+	chosen := pickWeightedVariant(link.Variants)
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    chosen.Name,
+		Path:     linkCookiePath(req),
+		MaxAge:   int(variantCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return chosen
+}
+
+func pickWeightedVariant(variants []Variant) *Variant {
+	total := 0
+	for _, variant := range variants {
+		total += variant.Weight
+	}
+
+	n := rand.IntN(total)
+	for i := range variants {
+		n -= variants[i].Weight
+		if n < 0 {
+			return &variants[i]
+		}
+	}
+	return &variants[len(variants)-1]
+}